@@ -19,6 +19,9 @@ type CreateOptions struct {
 	// If MakeParents is true, missing parent directories of Path are
 	// created with permissions 0755.
 	MakeParents bool
+	// If Exclusive is true, creating a file fails if Path already
+	// exists.
+	Exclusive bool
 }
 
 type Entry struct {
@@ -27,6 +30,14 @@ type Entry struct {
 	Hash string
 	Size int
 	Link string
+	// Owner is set when the ownership of the entry was changed.
+	Owner *Owner
+}
+
+// Owner identifies the user and group owning an entry.
+type Owner struct {
+	UID int
+	GID int
 }
 
 // Create creates a filesystem entry according to the provided options and returns
@@ -81,7 +92,11 @@ func createDir(o *CreateOptions) error {
 
 func createFile(o *CreateOptions) error {
 	debugf("Writing file: %s (mode %#o)", o.Path, o.Mode)
-	file, err := os.OpenFile(o.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, o.Mode)
+	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	if o.Exclusive {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(o.Path, flags, o.Mode)
 	if err != nil {
 		return err
 	}
@@ -80,6 +80,27 @@ var createTests = []createTest{{
 		// mode is not updated.
 		"/foo/": "dir 0765",
 	},
+}, {
+	options: fsutil.CreateOptions{
+		Path:      "foo",
+		Data:      bytes.NewBufferString("data1"),
+		Mode:      0644,
+		Exclusive: true,
+	},
+	result: map[string]string{
+		"/foo": "file 0644 5b41362b",
+	},
+}, {
+	options: fsutil.CreateOptions{
+		Path:      "foo",
+		Data:      bytes.NewBufferString("data1"),
+		Mode:      0644,
+		Exclusive: true,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.WriteFile(filepath.Join(dir, "foo"), nil, 0644), IsNil)
+	},
+	error: `open .*/foo: file exists`,
 }}
 
 func (s *S) TestCreate(c *C) {
@@ -0,0 +1,58 @@
+package scripts
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// AssertModule returns builtins for scripts that validate content, which
+// fail the script when the asserted condition doesn't hold. As with fail,
+// the error reports the position of the failed assertion in its
+// backtrace. These are meant to be added to the namespace of scripts
+// under their own names.
+func AssertModule() map[string]Value {
+	return map[string]Value{
+		"assert_eq":   starlark.NewBuiltin("assert_eq", assertEq),
+		"assert_true": starlark.NewBuiltin("assert_true", assertTrue),
+	}
+}
+
+func assertEq(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var actual, expected Value
+	var msg string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "actual", &actual, "expected", &expected, "msg?", &msg)
+	if err != nil {
+		return nil, err
+	}
+	equal, err := starlark.Equal(actual, expected)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	if !equal {
+		return nil, assertError(fn, msg, "expected %s, got %s", expected, actual)
+	}
+	return starlark.None, nil
+}
+
+func assertTrue(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var cond Value
+	var msg string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "cond", &cond, "msg?", &msg)
+	if err != nil {
+		return nil, err
+	}
+	if !cond.Truth() {
+		return nil, assertError(fn, msg, "expected true value, got %s", cond)
+	}
+	return starlark.None, nil
+}
+
+// assertError returns the error for a failed assertion, prefixed by msg
+// if provided or by the assertion name otherwise.
+func assertError(fn *starlark.Builtin, msg string, format string, args ...interface{}) error {
+	if msg == "" {
+		msg = fn.Name()
+	}
+	return fmt.Errorf("%s: "+format, append([]interface{}{msg}, args...)...)
+}
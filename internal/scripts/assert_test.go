@@ -0,0 +1,52 @@
+package scripts_test
+
+import (
+	"go.starlark.net/starlark"
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var assertTests = []struct {
+	script string
+	error  string
+}{
+	{script: `assert_eq(1, 1)`},
+	{script: `assert_eq(["a", 1], ["a", 1])`},
+	{script: `assert_eq(1, 2)`, error: `assert_eq: expected 2, got 1`},
+	{script: `assert_eq("a", "b", "bad value")`, error: `bad value: expected "b", got "a"`},
+	{script: `assert_eq({"a": 1}, {"a": 2}, msg="bad dict")`, error: `bad dict: expected {"a": 2}, got {"a": 1}`},
+	{script: `assert_eq(1)`, error: `assert_eq: missing argument for expected`},
+	{script: `assert_true(True)`},
+	{script: `assert_true([1])`},
+	{script: `assert_true([])`, error: `assert_true: expected true value, got \[\]`},
+	{script: `assert_true(0, "no entries")`, error: `no entries: expected true value, got 0`},
+}
+
+func (s *S) TestAssertModule(c *C) {
+	for _, test := range assertTests {
+		c.Logf("Script: %s", test.script)
+		err := scripts.Run(&scripts.RunOptions{
+			Label:     "test",
+			Namespace: scripts.AssertModule(),
+			Script:    test.script,
+		})
+		if test.error == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, test.error)
+		}
+	}
+}
+
+func (s *S) TestAssertBacktrace(c *C) {
+	err := scripts.Run(&scripts.RunOptions{
+		Label:     "test",
+		Namespace: scripts.AssertModule(),
+		Script:    "def check(x):\n    assert_eq(x, 1)\ncheck(2)\n",
+	})
+	evalErr, ok := err.(*starlark.EvalError)
+	c.Assert(ok, Equals, true)
+	c.Assert(evalErr.Msg, Equals, "assert_eq: expected 1, got 2")
+	c.Assert(evalErr.CallStack.At(1).Pos.String(), Equals, "test:2:14")
+}
@@ -0,0 +1,50 @@
+package scripts
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/canonical/chisel/internal/strdist"
+)
+
+// AllowGlobs returns a check function for use with ContentValue that
+// accepts only content paths matching at least one of the patterns.
+// Patterns support the wildcards documented in strdist.GlobPath, so
+// "/etc/**" accepts everything under /etc/ including the directory.
+func AllowGlobs(patterns ...string) func(path string) error {
+	return func(path string) error {
+		for _, pattern := range patterns {
+			if strdist.GlobPath(pattern, path) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", fs.ErrPermission, path)
+	}
+}
+
+// DenyGlobs returns a check function for use with ContentValue that
+// rejects content paths matching any of the patterns.
+func DenyGlobs(patterns ...string) func(path string) error {
+	return func(path string) error {
+		for _, pattern := range patterns {
+			if strdist.GlobPath(pattern, path) {
+				return fmt.Errorf("%w: %s", fs.ErrPermission, path)
+			}
+		}
+		return nil
+	}
+}
+
+// AllChecks returns a check function that accepts a path only if all the
+// provided checks accept it. Combining AllowGlobs with DenyGlobs this way
+// means deny patterns take precedence over allow patterns.
+func AllChecks(checks ...func(path string) error) func(path string) error {
+	return func(path string) error {
+		for _, check := range checks {
+			if err := check(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package scripts_test
+
+import (
+	"errors"
+	"io/fs"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var checksTests = []struct {
+	summary string
+	check   func(path string) error
+	allowed []string
+	denied  []string
+}{{
+	summary: "Allow globs",
+	check:   scripts.AllowGlobs("/etc/**", "/usr/bin/*"),
+	allowed: []string{"/etc/", "/etc/hosts", "/etc/ssl/certs/", "/usr/bin/foo"},
+	denied:  []string{"/", "/etcetera", "/usr/bin/", "/usr/bin/foo/bar", "/usr/lib/foo"},
+}, {
+	summary: "No allow globs",
+	check:   scripts.AllowGlobs(),
+	denied:  []string{"/", "/etc/hosts"},
+}, {
+	summary: "Deny globs",
+	check:   scripts.DenyGlobs("/etc/ssl/**", "/**.key"),
+	allowed: []string{"/", "/etc/", "/etc/hosts", "/etc/ssl"},
+	denied:  []string{"/etc/ssl/", "/etc/ssl/certs/foo", "/foo.key", "/usr/share/foo.key"},
+}, {
+	summary: "Deny takes precedence over allow",
+	check: scripts.AllChecks(
+		scripts.AllowGlobs("/etc/**"),
+		scripts.DenyGlobs("/etc/ssl/**"),
+	),
+	allowed: []string{"/etc/", "/etc/hosts", "/etc/ssl"},
+	denied:  []string{"/etc/ssl/", "/etc/ssl/private/foo", "/usr/", "/"},
+}}
+
+func (s *S) TestChecks(c *C) {
+	for _, test := range checksTests {
+		c.Logf("Summary: %s", test.summary)
+		for _, path := range test.allowed {
+			c.Assert(test.check(path), IsNil, Commentf("path: %s", path))
+		}
+		for _, path := range test.denied {
+			err := test.check(path)
+			c.Assert(err, ErrorMatches, "permission denied: "+path, Commentf("path: %s", path))
+			c.Assert(errors.Is(err, fs.ErrPermission), Equals, true)
+		}
+	}
+}
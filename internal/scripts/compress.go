@@ -0,0 +1,112 @@
+package scripts
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// CompressModule returns a module with functions to compress and
+// decompress gzip and zstd data. It's meant to be added to the namespace
+// of scripts, usually under the "compress" name. Decompressing data that
+// expands to more than maxSize bytes fails, unless maxSize is zero, so
+// that scripts cannot exhaust memory with decompression bombs.
+func CompressModule(maxSize int64) Value {
+	m := &compressModule{maxSize: maxSize}
+	return &starlarkstruct.Module{
+		Name: "compress",
+		Members: starlark.StringDict{
+			"gzip_compress":   starlark.NewBuiltin("compress.gzip_compress", m.gzipCompress),
+			"gzip_decompress": starlark.NewBuiltin("compress.gzip_decompress", m.gzipDecompress),
+			"zstd_compress":   starlark.NewBuiltin("compress.zstd_compress", m.zstdCompress),
+			"zstd_decompress": starlark.NewBuiltin("compress.zstd_decompress", m.zstdDecompress),
+		},
+	}
+}
+
+type compressModule struct {
+	maxSize int64
+}
+
+func (m *compressModule) gzipCompress(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err = io.Copy(writer, strings.NewReader(data))
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.Bytes(buf.String()), nil
+}
+
+func (m *compressModule) gzipDecompress(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := gzip.NewReader(strings.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid gzip data: %w", fn.Name(), err)
+	}
+	defer reader.Close()
+	return m.readAll(fn, reader)
+}
+
+func (m *compressModule) zstdCompress(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writer, err := zstd.NewWriter(&buf)
+	if err == nil {
+		_, err = io.Copy(writer, strings.NewReader(data))
+		if err == nil {
+			err = writer.Close()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+	return starlark.Bytes(buf.String()), nil
+}
+
+func (m *compressModule) zstdDecompress(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := zstd.NewReader(strings.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid zstd data: %w", fn.Name(), err)
+	}
+	defer reader.Close()
+	return m.readAll(fn, reader)
+}
+
+// readAll reads the decompressed data from r, enforcing the size limit.
+func (m *compressModule) readAll(fn *starlark.Builtin, r io.Reader) (Value, error) {
+	if m.maxSize > 0 {
+		r = io.LimitReader(r, m.maxSize+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid data: %w", fn.Name(), err)
+	}
+	if m.maxSize > 0 && int64(len(data)) > m.maxSize {
+		return nil, fmt.Errorf("%s: decompressed data exceeds %d bytes", fn.Name(), m.maxSize)
+	}
+	return starlark.Bytes(data), nil
+}
@@ -0,0 +1,45 @@
+package scripts_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var compressTests = []struct {
+	expr   string
+	result string
+	error  string
+}{
+	{expr: `compress.gzip_decompress(compress.gzip_compress("data1"))`, result: `b"data1"`},
+	{expr: `compress.gzip_decompress(compress.gzip_compress(b""))`, result: `b""`},
+	{expr: `compress.zstd_decompress(compress.zstd_compress("data1"))`, result: `b"data1"`},
+	{expr: `compress.gzip_compress("data1")[:2]`, result: `b"\x1f\x8b"`},
+	{expr: `compress.gzip_decompress(compress.gzip_compress("x" * 16))`, result: `b"xxxxxxxxxxxxxxxx"`},
+	{expr: `compress.gzip_decompress(compress.gzip_compress("x" * 17))`, error: `compress.gzip_decompress: decompressed data exceeds 16 bytes`},
+	{expr: `compress.zstd_decompress(compress.zstd_compress("x" * 17))`, error: `compress.zstd_decompress: decompressed data exceeds 16 bytes`},
+	{expr: `compress.gzip_decompress("data1")`, error: `compress.gzip_decompress: invalid gzip data: .*`},
+	{expr: `compress.zstd_decompress("data1")`, error: `compress.zstd_decompress: invalid data: .*`},
+	{expr: `compress.gzip_decompress(compress.gzip_compress("data1")[:10])`, error: `compress.gzip_decompress: invalid data: unexpected EOF`},
+}
+
+func (s *S) TestCompressModule(c *C) {
+	namespace := map[string]scripts.Value{"compress": scripts.CompressModule(16)}
+	for _, test := range compressTests {
+		c.Logf("Expression: %s", test.expr)
+		result, err := evalExpr(namespace, test.expr)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result)
+	}
+}
+
+func (s *S) TestCompressModuleUnlimited(c *C) {
+	namespace := map[string]scripts.Value{"compress": scripts.CompressModule(0)}
+	result, err := evalExpr(namespace, `len(compress.gzip_decompress(compress.gzip_compress("x" * 100000)))`)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, "100000")
+}
@@ -0,0 +1,40 @@
+package scripts
+
+import (
+	"errors"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// CoreModule returns the builtins that are made available to every script
+// by Run, unless the namespace provides its own values for the same names.
+func CoreModule() map[string]Value {
+	return map[string]Value{
+		"fail": starlark.NewBuiltin("fail", fail),
+	}
+}
+
+// fail aborts the script with an error message. When additional arguments
+// are provided, the message is formatted with them as done by the %
+// operator, so fail("cannot find %s", path) works as expected.
+func fail(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, errors.New("fail: unexpected keyword arguments")
+	}
+	if len(args) == 0 {
+		return nil, errors.New("fail: missing argument for msg")
+	}
+	msg, ok := starlark.AsString(args[0])
+	if !ok {
+		msg = args[0].String()
+	}
+	if len(args) > 1 {
+		formatted, err := starlark.Binary(syntax.PERCENT, starlark.String(msg), args[1:])
+		if err != nil {
+			return nil, err
+		}
+		msg = string(formatted.(starlark.String))
+	}
+	return nil, errors.New(msg)
+}
@@ -0,0 +1,58 @@
+package scripts_test
+
+import (
+	"go.starlark.net/starlark"
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var failTests = []struct {
+	script string
+	error  string
+}{
+	{script: `fail("oops")`, error: `oops`},
+	{script: `fail("cannot find %s in %d places", "/foo", 2)`, error: `cannot find /foo in 2 places`},
+	{script: `fail(42)`, error: `42`},
+	{script: `fail("%s %s", "a")`, error: `not enough arguments for format string`},
+	{script: `fail()`, error: `fail: missing argument for msg`},
+	{script: `fail("oops", code=1)`, error: `fail: unexpected keyword arguments`},
+}
+
+func (s *S) TestFail(c *C) {
+	for _, test := range failTests {
+		c.Logf("Script: %s", test.script)
+		err := scripts.Run(&scripts.RunOptions{
+			Label:  "test",
+			Script: "x = 1\n" + test.script,
+		})
+		c.Assert(err, ErrorMatches, test.error)
+	}
+}
+
+func (s *S) TestFailBacktrace(c *C) {
+	err := scripts.Run(&scripts.RunOptions{
+		Label:  "test",
+		Script: "def check(x):\n    if not x:\n        fail(\"invalid: %r\", x)\ncheck(0)\n",
+	})
+	evalErr, ok := err.(*starlark.EvalError)
+	c.Assert(ok, Equals, true)
+	c.Assert(evalErr.Msg, Equals, "invalid: 0")
+	c.Assert(evalErr.CallStack.At(1).Pos.String(), Equals, "test:3:13")
+	c.Assert(evalErr.Backtrace(), Matches, `(?s).*test:4:6: in <toplevel>.*test:3:13: in check.*invalid: 0`)
+}
+
+func (s *S) TestFailOverride(c *C) {
+	called := false
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{
+			"fail": starlark.NewBuiltin("fail", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				called = true
+				return starlark.None, nil
+			}),
+		},
+		Script: `fail("oops")`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(called, Equals, true)
+}
@@ -0,0 +1,113 @@
+package scripts
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// DictUtilsModule returns a module with helpers for nested dictionaries,
+// such as those decoded from JSON. It's meant to be added to the namespace
+// of scripts, usually under the "dictutils" name.
+func DictUtilsModule() Value {
+	return &starlarkstruct.Module{
+		Name: "dictutils",
+		Members: starlark.StringDict{
+			"merge":    starlark.NewBuiltin("dictutils.merge", dictMerge),
+			"get_path": starlark.NewBuiltin("dictutils.get_path", dictGetPath),
+		},
+	}
+}
+
+// dictMerge returns a new dictionary with the entries of a updated by the
+// ones in b. Values that are dictionaries in both are merged recursively,
+// and otherwise the value in b wins. Neither a nor b are changed, and
+// dictionaries in the result are never shared with them.
+func dictMerge(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var a, b *starlark.Dict
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "a", &a, "b", &b)
+	if err != nil {
+		return nil, err
+	}
+	return mergeDicts(a, b)
+}
+
+func mergeDicts(a, b *starlark.Dict) (*starlark.Dict, error) {
+	result := starlark.NewDict(a.Len())
+	for _, item := range a.Items() {
+		value, err := copyDicts(item[1])
+		if err != nil {
+			return nil, err
+		}
+		err = result.SetKey(item[0], value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range b.Items() {
+		old, found, err := result.Get(item[0])
+		if err != nil {
+			return nil, err
+		}
+		var value Value
+		oldDict, oldOk := old.(*starlark.Dict)
+		newDict, newOk := item[1].(*starlark.Dict)
+		if found && oldOk && newOk {
+			value, err = mergeDicts(oldDict, newDict)
+		} else {
+			value, err = copyDicts(item[1])
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = result.SetKey(item[0], value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// copyDicts returns a copy of value if it's a dictionary, with nested
+// dictionaries copied as well, so that changing the result of a merge
+// never changes its arguments. Other values are returned as they are.
+func copyDicts(value Value) (Value, error) {
+	d, ok := value.(*starlark.Dict)
+	if !ok {
+		return value, nil
+	}
+	return mergeDicts(d, starlark.NewDict(0))
+}
+
+// dictGetPath returns the value found by following the dot-separated keys
+// in path through nested dictionaries, or default if any of them is
+// missing or holds something other than a dictionary.
+func dictGetPath(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var d *starlark.Dict
+	var path string
+	var fallback Value = starlark.None
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "d", &d, "path", &path, "default?", &fallback)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%s: empty path", fn.Name())
+	}
+	var value Value = d
+	for _, key := range strings.Split(path, ".") {
+		dict, ok := value.(*starlark.Dict)
+		if !ok {
+			return fallback, nil
+		}
+		value, ok, err = dict.Get(starlark.String(key))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return fallback, nil
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,45 @@
+package scripts_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var dictUtilsTests = []struct {
+	expr   string
+	result string
+	error  string
+}{
+	{expr: `dictutils.merge({}, {})`, result: `{}`},
+	{expr: `dictutils.merge({"a": 1, "b": 2}, {"b": 3, "c": 4})`, result: `{"a": 1, "b": 3, "c": 4}`},
+	{expr: `dictutils.merge({"a": {"x": 1, "y": 2}}, {"a": {"y": 3, "z": 4}})`, result: `{"a": {"x": 1, "y": 3, "z": 4}}`},
+	{expr: `dictutils.merge({"a": {"x": 1}}, {"a": [1]})`, result: `{"a": [1]}`},
+	{expr: `dictutils.merge({"a": 1}, {"a": {"x": 1}})`, result: `{"a": {"x": 1}}`},
+	{expr: `dictutils.merge({"a": [1]}, {"a": [2]})`, result: `{"a": [2]}`},
+	{expr: `(lambda a: [dictutils.merge(a, {"x": {"z": 2}}), a])({"x": {"y": 1}})`, result: `[{"x": {"y": 1, "z": 2}}, {"x": {"y": 1}}]`},
+	{expr: `(lambda a: (lambda r: [r["x"].update(z=2), a])(dictutils.merge(a, {})))({"x": {"y": 1}})`, result: `[None, {"x": {"y": 1}}]`},
+	{expr: `(lambda b: (lambda r: [r["x"].update(z=2), b])(dictutils.merge({}, b)))({"x": {"y": 1}})`, result: `[None, {"x": {"y": 1}}]`},
+	{expr: `dictutils.merge({"a": 1}, [])`, error: `dictutils.merge: for parameter b: got list, want dict`},
+	{expr: `dictutils.get_path({"a": {"b": {"c": 1}}}, "a.b.c")`, result: `1`},
+	{expr: `dictutils.get_path({"a": {"b": {"c": 1}}}, "a.b")`, result: `{"c": 1}`},
+	{expr: `dictutils.get_path({"a": {"b": 1}}, "a.x")`, result: `None`},
+	{expr: `dictutils.get_path({"a": {"b": 1}}, "a.b.c", "none")`, result: `"none"`},
+	{expr: `dictutils.get_path({"a": 1}, "x", default=0)`, result: `0`},
+	{expr: `dictutils.get_path({"a": 1}, "")`, error: `dictutils.get_path: empty path`},
+	{expr: `dictutils.get_path({"a": {"b": [1]}}, "a.b.0")`, result: `None`},
+}
+
+func (s *S) TestDictUtilsModule(c *C) {
+	namespace := map[string]scripts.Value{"dictutils": scripts.DictUtilsModule()}
+	for _, test := range dictUtilsTests {
+		c.Logf("Expression: %s", test.expr)
+		result, err := evalExpr(namespace, test.expr)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result)
+	}
+}
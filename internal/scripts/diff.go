@@ -0,0 +1,230 @@
+// This file was adapted from the internal/diff package of the Go
+// standard library (src/internal/diff/diff.go).
+//
+// Copyright 2022 The Go Authors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * Neither the name of Google LLC nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package scripts
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// unifiedDiff returns a unified diff of the lines in old and new, with
+// three lines of context, or an empty string if they are equal.
+//
+// The diff is anchored on lines that appear exactly once in each side,
+// as done by patience diff, so it takes O(n log n) time and O(n) memory
+// even for inputs that have nothing in common. That means the result is
+// not always minimal, but it's well suited for human consumption.
+func unifiedDiff(oldName, old, newName, new string) string {
+	if old == new {
+		return ""
+	}
+	x := diffLines(old)
+	y := diffLines(new)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+
+	const context = 3
+	var done, chunk, count diffPair
+	var ctext []string
+	for _, m := range diffAnchors(x, y) {
+		if m.x < done.x {
+			// Already handled scanning forward from earlier match.
+			continue
+		}
+		// Expand the matching lines as far as possible in both
+		// directions.
+		start := m
+		for start.x > done.x && start.y > done.y && x[start.x-1] == y[start.y-1] {
+			start.x--
+			start.y--
+		}
+		end := m
+		for end.x < len(x) && end.y < len(y) && x[end.x] == y[end.y] {
+			end.x++
+			end.y++
+		}
+
+		// Emit the mismatched lines before start into the chunk.
+		for _, s := range x[done.x:start.x] {
+			ctext = append(ctext, "-"+s)
+			count.x++
+		}
+		for _, s := range y[done.y:start.y] {
+			ctext = append(ctext, "+"+s)
+			count.y++
+		}
+
+		// If not at the end and there are too few common lines to
+		// separate chunks, the chunk includes them and continues.
+		if (end.x < len(x) || end.y < len(y)) && (end.x-start.x < context || (len(ctext) > 0 && end.x-start.x < 2*context)) {
+			for _, s := range x[start.x:end.x] {
+				ctext = append(ctext, " "+s)
+				count.x++
+				count.y++
+			}
+			done = end
+			continue
+		}
+
+		// End the chunk with common lines for context.
+		if len(ctext) > 0 {
+			n := end.x - start.x
+			if n > context {
+				n = context
+			}
+			for _, s := range x[start.x : start.x+n] {
+				ctext = append(ctext, " "+s)
+				count.x++
+				count.y++
+			}
+			done = diffPair{start.x + n, start.y + n}
+
+			// Line numbers are 1-based, except for empty ranges.
+			if count.x > 0 {
+				chunk.x++
+			}
+			if count.y > 0 {
+				chunk.y++
+			}
+			fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", chunk.x, count.x, chunk.y, count.y)
+			for _, s := range ctext {
+				out.WriteString(s)
+			}
+			count = diffPair{}
+			ctext = ctext[:0]
+		}
+
+		if end.x >= len(x) && end.y >= len(y) {
+			break
+		}
+
+		// Start a new chunk with the preceding common lines.
+		chunk = diffPair{end.x - context, end.y - context}
+		for _, s := range x[chunk.x:end.x] {
+			ctext = append(ctext, " "+s)
+			count.x++
+			count.y++
+		}
+		done = end
+	}
+	return out.String()
+}
+
+type diffPair struct {
+	x, y int
+}
+
+// diffLines splits s into lines, each ending with a newline. A missing
+// newline at the end is noted as diff(1) does.
+func diffLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] += "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
+
+// diffAnchors returns the pairs of indexes of the longest common
+// subsequence of the lines that appear exactly once in both x and y,
+// with the additional pairs {0, 0} and {len(x), len(y)} at either end.
+func diffAnchors(x, y []string) []diffPair {
+	// Count occurrences as 0, 1 or many, using negative numbers so that
+	// positive ones may be used for indexes below: -1 and -2 for x, and
+	// -4 and -8 for y.
+	m := make(map[string]int)
+	for _, s := range x {
+		if c := m[s]; c > -2 {
+			m[s] = c - 1
+		}
+	}
+	for _, s := range y {
+		if c := m[s]; c > -8 {
+			m[s] = c - 4
+		}
+	}
+
+	// Collect the indexes of unique lines in y, and of unique lines in
+	// x together with the position in yi of the same line.
+	var xi, yi, inv []int
+	for i, s := range y {
+		if m[s] == -1+-4 {
+			m[s] = len(yi)
+			yi = append(yi, i)
+		}
+	}
+	for i, s := range x {
+		if j, ok := m[s]; ok && j >= 0 {
+			xi = append(xi, i)
+			inv = append(inv, j)
+		}
+	}
+
+	// Find the longest increasing subsequence of inv, following
+	// Algorithm A from Szymanski's "A special case of the maximal common
+	// subsequence problem".
+	n := len(xi)
+	T := make([]int, n)
+	L := make([]int, n)
+	for i := range T {
+		T[i] = n + 1
+	}
+	for i := 0; i < n; i++ {
+		k := sort.Search(n, func(k int) bool {
+			return T[k] >= inv[i]
+		})
+		T[k] = inv[i]
+		L[i] = k + 1
+	}
+	k := 0
+	for _, v := range L {
+		if k < v {
+			k = v
+		}
+	}
+	seq := make([]diffPair, 2+k)
+	seq[1+k] = diffPair{len(x), len(y)}
+	lastj := n
+	for i := n - 1; i >= 0; i-- {
+		if L[i] == k && inv[i] < lastj {
+			seq[k] = diffPair{xi[i], yi[inv[i]]}
+			k--
+			lastj = inv[i]
+		}
+	}
+	seq[0] = diffPair{0, 0}
+	return seq
+}
@@ -0,0 +1,82 @@
+package scripts
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// EncodingModule returns a module with functions to encode and decode
+// data as base64 or hex. It's meant to be added to the namespace of
+// scripts, usually under the "encoding" name.
+func EncodingModule() Value {
+	return &starlarkstruct.Module{
+		Name: "encoding",
+		Members: starlark.StringDict{
+			"b64encode": starlark.NewBuiltin("encoding.b64encode", b64encode),
+			"b64decode": starlark.NewBuiltin("encoding.b64decode", b64decode),
+			"hexencode": starlark.NewBuiltin("encoding.hexencode", hexencode),
+			"hexdecode": starlark.NewBuiltin("encoding.hexdecode", hexdecode),
+		},
+	}
+}
+
+// unpackData unpacks the single argument of fn, which may be either a
+// string or bytes.
+func unpackData(fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (string, error) {
+	var data Value
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "data", &data)
+	if err != nil {
+		return "", err
+	}
+	switch data := data.(type) {
+	case starlark.String:
+		return string(data), nil
+	case starlark.Bytes:
+		return string(data), nil
+	}
+	return "", fmt.Errorf("%s: for parameter data: got %s, want string or bytes", fn.Name(), data.Type())
+}
+
+func b64encode(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(base64.StdEncoding.EncodeToString([]byte(data))), nil
+}
+
+func b64decode(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid base64 data: %w", fn.Name(), err)
+	}
+	return starlark.Bytes(decoded), nil
+}
+
+func hexencode(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(hex.EncodeToString([]byte(data))), nil
+}
+
+func hexdecode(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid hex data: %w", fn.Name(), err)
+	}
+	return starlark.Bytes(decoded), nil
+}
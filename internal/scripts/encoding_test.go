@@ -0,0 +1,41 @@
+package scripts_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var encodingTests = []struct {
+	expr   string
+	result string
+	error  string
+}{
+	{expr: `encoding.b64encode("")`, result: `""`},
+	{expr: `encoding.b64encode("data1")`, result: `"ZGF0YTE="`},
+	{expr: `encoding.b64encode(b"\x00\xff")`, result: `"AP8="`},
+	{expr: `encoding.b64decode("ZGF0YTE=")`, result: `b"data1"`},
+	{expr: `encoding.b64decode(b"AP8=")`, result: `b"\x00\xff"`},
+	{expr: `encoding.b64decode("")`, result: `b""`},
+	{expr: `encoding.b64decode("ZGF0YTE")`, error: `encoding.b64decode: invalid base64 data: illegal base64 data at input byte 4`},
+	{expr: `encoding.hexencode("data1")`, result: `"6461746131"`},
+	{expr: `encoding.hexencode(b"\x00\xff")`, result: `"00ff"`},
+	{expr: `encoding.hexdecode("00FF")`, result: `b"\x00\xff"`},
+	{expr: `encoding.hexdecode("0")`, error: `encoding.hexdecode: invalid hex data: encoding/hex: odd length hex string`},
+	{expr: `encoding.hexdecode("zz")`, error: `encoding.hexdecode: invalid hex data: encoding/hex: invalid byte: U\+007A 'z'`},
+	{expr: `encoding.hexencode(1)`, error: `encoding.hexencode: for parameter data: got int, want string or bytes`},
+}
+
+func (s *S) TestEncodingModule(c *C) {
+	namespace := map[string]scripts.Value{"encoding": scripts.EncodingModule()}
+	for _, test := range encodingTests {
+		c.Logf("Expression: %s", test.expr)
+		result, err := evalExpr(namespace, test.expr)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result)
+	}
+}
@@ -0,0 +1,72 @@
+package scripts
+
+import (
+	"go.starlark.net/starlark"
+
+	"github.com/canonical/chisel/internal/fsutil"
+)
+
+// EntryValue exposes the details of a filesystem entry to scripts.
+// The value holds a copy of the entry, so it is immutable and may be
+// shared freely.
+type EntryValue struct {
+	entry fsutil.Entry
+}
+
+func NewEntryValue(entry *fsutil.Entry) *EntryValue {
+	return &EntryValue{entry: *entry}
+}
+
+// Entry returns a copy of the entry described by the value.
+func (e *EntryValue) Entry() *fsutil.Entry {
+	entry := e.entry
+	return &entry
+}
+
+// Entry starlark.Value interface
+// --------------------------------------------------------------------------
+
+func (e *EntryValue) String() string {
+	return "Entry{" + e.entry.Path + "}"
+}
+
+func (e *EntryValue) Type() string {
+	return "Entry"
+}
+
+func (e *EntryValue) Freeze() {
+	// Entries are immutable already.
+}
+
+func (e *EntryValue) Truth() starlark.Bool {
+	return true
+}
+
+func (e *EntryValue) Hash() (uint32, error) {
+	return starlark.String(e.entry.Path).Hash()
+}
+
+// Entry starlark.HasAttrs interface
+// --------------------------------------------------------------------------
+
+var _ starlark.HasAttrs = new(EntryValue)
+
+func (e *EntryValue) Attr(name string) (Value, error) {
+	switch name {
+	case "path":
+		return starlark.String(e.entry.Path), nil
+	case "mode":
+		return starlark.MakeUint(uint(e.entry.Mode.Perm())), nil
+	case "size":
+		return starlark.MakeInt(e.entry.Size), nil
+	case "link":
+		return starlark.String(e.entry.Link), nil
+	case "hash":
+		return starlark.String(e.entry.Hash), nil
+	}
+	return nil, nil
+}
+
+func (e *EntryValue) AttrNames() []string {
+	return []string{"path", "mode", "size", "link", "hash"}
+}
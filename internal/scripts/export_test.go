@@ -0,0 +1,28 @@
+package scripts
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// OutputBuiltin writes its stdout and stderr arguments to the respective
+// writers of the running script.
+var OutputBuiltin = starlark.NewBuiltin("output", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var stdout, stderr string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "stdout?", &stdout, "stderr?", &stderr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(threadStdout(thread), stdout)
+	fmt.Fprint(threadStderr(thread), stderr)
+	return starlark.None, nil
+})
+
+// FakeRename replaces the function used to rename files, returning a
+// function that restores the original one.
+func FakeRename(f func(oldpath, newpath string) error) (restore func()) {
+	old := osRename
+	osRename = f
+	return func() { osRename = old }
+}
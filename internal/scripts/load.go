@@ -0,0 +1,67 @@
+package scripts
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"go.starlark.net/starlark"
+)
+
+// loadResult holds the outcome of loading a module, which is reused when
+// the same module is loaded again in the same run.
+type loadResult struct {
+	globals starlark.StringDict
+	err     error
+}
+
+// ContentLoader returns a function for RunOptions.Load that loads modules
+// from within c, so that load("/lib/helpers.star", "f") reads the module
+// source at that content path. Modules are resolved with the same dialect
+// as the script, see only the core builtins, and may load other modules
+// themselves. Each module is executed once per run, and cyclic loads fail.
+func ContentLoader(c *ContentValue) func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	key := fmt.Sprintf("scripts.loads.%p", c)
+	return func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+		loads, _ := thread.Local(key).(map[string]*loadResult)
+		if loads == nil {
+			loads = make(map[string]*loadResult)
+			thread.SetLocal(key, loads)
+		}
+		module = filepath.Clean(module)
+		if result, ok := loads[module]; ok {
+			if result == nil {
+				return nil, fmt.Errorf("cycle in load graph")
+			}
+			return result.globals, result.err
+		}
+		// A nil result marks the module as being loaded.
+		loads[module] = nil
+		globals, err := c.loadModule(thread, module)
+		loads[module] = &loadResult{globals, err}
+		return globals, err
+	}
+}
+
+func (c *ContentValue) loadModule(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	fpath, err := c.RealPath(module, CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.readFile(starlark.String(module), fpath)
+	if err != nil {
+		return nil, err
+	}
+	predeclared := starlark.StringDict(CoreModule())
+	// The running script already holds the dialect, so the module is
+	// resolved directly rather than via compile.
+	_, prog, err := starlark.SourceProgram(module, data, predeclared.Has)
+	if err != nil {
+		return nil, err
+	}
+	globals, err := prog.Init(thread, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+	return globals, nil
+}
@@ -0,0 +1,72 @@
+package scripts_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+func (s *S) TestContentLoader(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "lib"), 0755), IsNil)
+	files := map[string]string{
+		"lib/paths.star": string(testutil.Reindent(`
+			def join(a, b):
+				return a.rstrip("/") + "/" + b
+		`)),
+		"lib/helpers.star": string(testutil.Reindent(`
+			load("/lib/paths.star", "join")
+			def write_all(content, dir, files):
+				for name, data in files.items():
+					content.write(join(dir, name), data, make_parents=True)
+		`)),
+		"lib/cycle1.star": `load("/lib/cycle2.star", "x")`,
+		"lib/cycle2.star": `load("/lib/cycle1.star", "x")`,
+		"lib/bad.star":    `x = undefined`,
+		"lib/data.star":   `items = []`,
+	}
+	for name, data := range files {
+		c.Assert(os.WriteFile(filepath.Join(rootDir, name), []byte(data), 0644), IsNil)
+	}
+
+	content := &scripts.ContentValue{RootDir: rootDir}
+	run := func(script string) error {
+		return scripts.Run(&scripts.RunOptions{
+			Label:   "main",
+			Content: content,
+			Script:  string(testutil.Reindent(script)),
+			Load:    scripts.ContentLoader(content),
+		})
+	}
+	err := run(`
+		load("/lib/helpers.star", "write_all")
+		load("/lib/paths.star", "join")
+		write_all(content, "/out/", {"file1.txt": "data1"})
+		content.write(join("/out", "file2.txt"), "data2")
+	`)
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(filepath.Join(rootDir, "out")), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+		"/file2.txt": "file 0644 d98cf53e",
+	})
+
+	err = run(`load("/lib/cycle1.star", "x")`)
+	c.Assert(err, ErrorMatches, `cannot load /lib/cycle1.star: cannot load /lib/cycle2.star: cannot load /lib/cycle1.star: cycle in load graph`)
+	err = run(`load("/lib/bad.star", "x")`)
+	c.Assert(err, ErrorMatches, `cannot load /lib/bad.star: /lib/bad.star:1:5: undefined: undefined`)
+	err = run(`load("/lib/missing.star", "x")`)
+	c.Assert(err, ErrorMatches, `cannot load /lib/missing.star: open /lib/missing.star: no such file or directory`)
+	err = run(`load("/lib/paths.star", "missing")`)
+	c.Assert(err, ErrorMatches, `load: name missing not found in module /lib/paths.star`)
+
+	// Modules are frozen once loaded.
+	err = run(`
+		load("/lib/data.star", "items")
+		items.append(1)
+	`)
+	c.Assert(err, ErrorMatches, `append: cannot append to frozen list`)
+}
@@ -0,0 +1,81 @@
+package scripts
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// LogLevel is the minimum severity of messages emitted by the LogModule.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota - 1
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "debug",
+	LogInfo:  "info",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+// logLevelKey is the thread-local key holding RunOptions.LogLevel.
+const logLevelKey = "scripts.loglevel"
+
+// LogModule returns a module with the debug, info, warn and error functions
+// for scripts to emit leveled diagnostics. Arguments are formatted as done
+// by print, and the message is prefixed with the script label and level.
+// Debug and info messages go to RunOptions.Stdout, and the others to
+// RunOptions.Stderr, provided their level is not below RunOptions.LogLevel.
+// It's meant to be added to the namespace of scripts, usually under the
+// "log" name.
+func LogModule() Value {
+	members := make(starlark.StringDict, len(logLevelNames))
+	for level, name := range logLevelNames {
+		members[name] = starlark.NewBuiltin("log."+name, logFunc(level))
+	}
+	return &starlarkstruct.Module{Name: "log", Members: members}
+}
+
+func logFunc(level LogLevel) func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	return func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+		if len(kwargs) > 0 {
+			return nil, fmt.Errorf("%s: unexpected keyword arguments", fn.Name())
+		}
+		min, _ := thread.Local(logLevelKey).(LogLevel)
+		if level < min {
+			return starlark.None, nil
+		}
+		var msg strings.Builder
+		if thread.Name != "" {
+			msg.WriteString(thread.Name)
+			msg.WriteString(": ")
+		}
+		msg.WriteString(logLevelNames[level])
+		msg.WriteString(":")
+		for _, arg := range args {
+			msg.WriteByte(' ')
+			if s, ok := starlark.AsString(arg); ok {
+				msg.WriteString(s)
+			} else {
+				msg.WriteString(arg.String())
+			}
+		}
+		msg.WriteByte('\n')
+		w := threadStdout(thread)
+		if level >= LogWarn {
+			w = threadStderr(thread)
+		}
+		_, err := w.Write([]byte(msg.String()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		return starlark.None, nil
+	}
+}
@@ -0,0 +1,58 @@
+package scripts_test
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+var logModuleTests = []struct {
+	level  scripts.LogLevel
+	stdout string
+	stderr string
+}{{
+	level:  scripts.LogDebug,
+	stdout: "build: debug: value 1\nbuild: info: path /foo [1, 2]\n",
+	stderr: "build: warn: \"quoted\" \nbuild: error:\n",
+}, {
+	level:  scripts.LogInfo,
+	stdout: "build: info: path /foo [1, 2]\n",
+	stderr: "build: warn: \"quoted\" \nbuild: error:\n",
+}, {
+	level:  scripts.LogWarn,
+	stderr: "build: warn: \"quoted\" \nbuild: error:\n",
+}, {
+	level:  scripts.LogError,
+	stderr: "build: error:\n",
+}}
+
+func (s *S) TestLogModule(c *C) {
+	for _, test := range logModuleTests {
+		c.Logf("Level: %d", test.level)
+		var stdout, stderr bytes.Buffer
+		err := scripts.Run(&scripts.RunOptions{
+			Label:     "build",
+			Namespace: map[string]scripts.Value{"log": scripts.LogModule()},
+			Script: string(testutil.Reindent(`
+				log.debug("value", 1)
+				log.info("path", "/foo", [1, 2])
+				log.warn(repr("quoted"), "")
+				log.error()
+			`)),
+			Stdout:   &stdout,
+			Stderr:   &stderr,
+			LogLevel: test.level,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(stdout.String(), Equals, test.stdout)
+		c.Assert(stderr.String(), Equals, test.stderr)
+	}
+}
+
+func (s *S) TestLogModuleErrors(c *C) {
+	_, err := evalExpr(map[string]scripts.Value{"log": scripts.LogModule()}, `log.info(msg="x")`)
+	c.Assert(err, ErrorMatches, "log.info: unexpected keyword arguments")
+}
@@ -0,0 +1,168 @@
+package scripts
+
+import (
+	"fmt"
+	"regexp"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// RegexModule returns a module with functions to match and replace text
+// using regular expressions in the RE2 syntax, which run in time linear
+// in the size of the input. It's meant to be added to the namespace of
+// scripts, usually under the "regex" name.
+func RegexModule() Value {
+	return &starlarkstruct.Module{
+		Name: "regex",
+		Members: starlark.StringDict{
+			"compile": starlark.NewBuiltin("regex.compile", regexCompile),
+			"match":   starlark.NewBuiltin("regex.match", regexMatch),
+			"findall": starlark.NewBuiltin("regex.findall", regexFindAll),
+			"replace": starlark.NewBuiltin("regex.replace", regexReplace),
+		},
+	}
+}
+
+// PatternValue is a compiled regular expression. It is immutable, and
+// its functions are available as methods as well.
+type PatternValue struct {
+	re *regexp.Regexp
+}
+
+var _ starlark.HasAttrs = (*PatternValue)(nil)
+
+func (p *PatternValue) String() string {
+	return fmt.Sprintf("regex.compile(%s)", starlark.String(p.re.String()))
+}
+
+func (p *PatternValue) Type() string {
+	return "regex.Pattern"
+}
+
+func (p *PatternValue) Freeze() {}
+
+func (p *PatternValue) Truth() starlark.Bool {
+	return true
+}
+
+func (p *PatternValue) Hash() (uint32, error) {
+	return starlark.String(p.re.String()).Hash()
+}
+
+var patternMethods = map[string]func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error){
+	"match":   regexMatch,
+	"findall": regexFindAll,
+	"replace": regexReplace,
+}
+
+func (p *PatternValue) Attr(name string) (Value, error) {
+	if name == "pattern" {
+		return starlark.String(p.re.String()), nil
+	}
+	method, ok := patternMethods[name]
+	if !ok {
+		return nil, nil
+	}
+	return starlark.NewBuiltin("regex.Pattern."+name, func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+		return method(thread, fn, append(starlark.Tuple{p}, args...), kwargs)
+	}), nil
+}
+
+func (p *PatternValue) AttrNames() []string {
+	return []string{"findall", "match", "pattern", "replace"}
+}
+
+// unpackPattern returns the regular expression provided either as a
+// string or as a compiled pattern.
+func unpackPattern(fn *starlark.Builtin, pattern Value) (*regexp.Regexp, error) {
+	switch pattern := pattern.(type) {
+	case *PatternValue:
+		return pattern.re, nil
+	case starlark.String:
+		re, err := regexp.Compile(string(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern: %w", fn.Name(), err)
+		}
+		return re, nil
+	}
+	return nil, fmt.Errorf("%s: for parameter pattern: got %s, want string or regex.Pattern", fn.Name(), pattern.Type())
+}
+
+func regexCompile(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var pattern Value
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "pattern", &pattern)
+	if err != nil {
+		return nil, err
+	}
+	re, err := unpackPattern(fn, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &PatternValue{re: re}, nil
+}
+
+// regexMatch reports whether the pattern matches anywhere in the text.
+func regexMatch(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var pattern Value
+	var text string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "pattern", &pattern, "text", &text)
+	if err != nil {
+		return nil, err
+	}
+	re, err := unpackPattern(fn, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.Bool(re.MatchString(text)), nil
+}
+
+// regexFindAll returns all non-overlapping matches of the pattern in the
+// text. As in Python, each match is the whole matched text when the
+// pattern has no groups, the text of the group when it has one, and a
+// tuple with the text of every group otherwise.
+func regexFindAll(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var pattern Value
+	var text string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "pattern", &pattern, "text", &text)
+	if err != nil {
+		return nil, err
+	}
+	re, err := unpackPattern(fn, pattern)
+	if err != nil {
+		return nil, err
+	}
+	matches := re.FindAllStringSubmatch(text, -1)
+	values := make([]Value, len(matches))
+	for i, match := range matches {
+		switch len(match) {
+		case 1:
+			values[i] = starlark.String(match[0])
+		case 2:
+			values[i] = starlark.String(match[1])
+		default:
+			groups := make(starlark.Tuple, len(match)-1)
+			for j, group := range match[1:] {
+				groups[j] = starlark.String(group)
+			}
+			values[i] = groups
+		}
+	}
+	return starlark.NewList(values), nil
+}
+
+// regexReplace replaces all matches of the pattern in the text with repl,
+// where $1 or ${name} refer to the text of the respective group.
+func regexReplace(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var pattern Value
+	var text, repl string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "pattern", &pattern, "text", &text, "repl", &repl)
+	if err != nil {
+		return nil, err
+	}
+	re, err := unpackPattern(fn, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(re.ReplaceAllString(text, repl)), nil
+}
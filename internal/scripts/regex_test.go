@@ -0,0 +1,45 @@
+package scripts_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var regexTests = []struct {
+	expr   string
+	result string
+	error  string
+}{
+	{expr: `regex.match("b+", "abbc")`, result: `True`},
+	{expr: `regex.match("^b", "abbc")`, result: `False`},
+	{expr: `regex.findall("[0-9]+", "a1 b22 c333")`, result: `["1", "22", "333"]`},
+	{expr: `regex.findall("([a-z])[0-9]+", "a1 b22")`, result: `["a", "b"]`},
+	{expr: `regex.findall("([a-z])([0-9]+)", "a1 b22")`, result: `[("a", "1"), ("b", "22")]`},
+	{expr: `regex.findall("x", "abc")`, result: `[]`},
+	{expr: `regex.replace("([a-z])([0-9])", "a1 b2", "${2}$1")`, result: `"1a 2b"`},
+	{expr: `regex.compile("a+")`, result: `regex.compile("a+")`},
+	{expr: `regex.compile("a+").pattern`, result: `"a+"`},
+	{expr: `regex.compile("a+").match("baa")`, result: `True`},
+	{expr: `regex.compile("a+").findall("baab")`, result: `["aa"]`},
+	{expr: `regex.compile("a+").replace("baab", "-")`, result: `"b-b"`},
+	{expr: `regex.findall(regex.compile("[ab]"), "abc")`, result: `["a", "b"]`},
+	{expr: `regex.compile("(")`, error: `regex.compile: invalid pattern: error parsing regexp: missing closing \): .*`},
+	{expr: `regex.match("(", "a")`, error: `regex.match: invalid pattern: error parsing regexp: missing closing \): .*`},
+	{expr: `regex.match(1, "a")`, error: `regex.match: for parameter pattern: got int, want string or regex.Pattern`},
+	{expr: `regex.compile("a").search`, error: `regex.Pattern has no .search field or method`},
+}
+
+func (s *S) TestRegexModule(c *C) {
+	namespace := map[string]scripts.Value{"regex": scripts.RegexModule()}
+	for _, test := range regexTests {
+		c.Logf("Expression: %s", test.expr)
+		result, err := evalExpr(namespace, test.expr)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result)
+	}
+}
@@ -1,13 +1,39 @@
 package scripts
 
 import (
+	"go.starlark.net/lib/json"
 	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
 
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/canonical/chisel/internal/fsutil"
+	"github.com/canonical/chisel/internal/strdist"
 )
 
 func init() {
@@ -20,19 +46,543 @@ type RunOptions struct {
 	Label     string
 	Namespace map[string]Value
 	Script    string
+	// ScriptReader provides the script source in place of Script.
+	ScriptReader io.Reader
+	// Content, if set, is made available to the script under the name
+	// "content", which must not be otherwise defined by the options.
+	// It's a shortcut for the common case of scripts handling a single
+	// tree.
+	Content *ContentValue
+	// Contents holds content values that are made available to the
+	// script under the respective names, in addition to Namespace.
+	// Names must not collide with entries in Namespace.
+	Contents map[string]*ContentValue
+	// AllowRecursion enables while loops and recursive function calls
+	// for the run. Both are disabled by default, as they allow a script
+	// to run without bounds. The setting is shared by the whole process,
+	// so runs that enable it never execute at the same time as runs that
+	// don't, and one of them waits for the others to finish.
+	AllowRecursion bool
+	// Constants holds configuration values that are made available to
+	// the script as strings, in addition to Namespace and Contents.
+	// Names must not collide with entries in either of them.
+	Constants map[string]string
+	// FixedTime, if not zero, is returned by the now function of the
+	// TimeModule in place of the current time, for reproducible output.
+	FixedTime time.Time
+	// Load is called to load the modules named in load statements,
+	// which fail when it is nil. See ContentLoader.
+	Load func(thread *starlark.Thread, module string) (starlark.StringDict, error)
+	// StrictGlobals rejects scripts that bind a global name more than
+	// once, or that bind a name provided by the options, such as the
+	// injected content. By default both are allowed.
+	StrictGlobals bool
+	// Stdout and Stderr receive the output that builtins produce on
+	// behalf of the script, such as logging and debug dumps. Output is
+	// discarded when they are nil.
+	Stdout io.Writer
+	Stderr io.Writer
+	// LogLevel is the minimum level of the messages emitted via the
+	// LogModule. It defaults to LogInfo, so debug messages are dropped.
+	LogLevel LogLevel
 }
 
 func Run(opts *RunOptions) error {
-	thread := &starlark.Thread{Name: opts.Label}
-	globals, err := starlark.ExecFile(thread, opts.Label, opts.Script, opts.Namespace)
-	_ = globals
-	return err
+	namespace, err := buildNamespace(opts)
+	if err != nil {
+		return err
+	}
+	var src interface{} = opts.Script
+	if opts.ScriptReader != nil {
+		if opts.Script != "" {
+			return fmt.Errorf("cannot provide both Script and ScriptReader")
+		}
+		src = opts.ScriptReader
+	}
+	program, err := compile(opts.Label, src, namespace.Has, opts.AllowRecursion)
+	if err != nil {
+		return err
+	}
+	return program.run(namespace, opts)
+}
+
+// dialect guards resolve.AllowRecursion, which is shared by the whole
+// process and consulted both when resolving while loops and when calling
+// functions, so it must hold for as long as a run executes. Any number
+// of holders may share it while they agree on the setting, so runs only
+// wait for those that want the opposite one, and compiling only holds it
+// for scripts with while loops. Waiting holders of one setting keep new
+// holders of the other from joining, so neither may starve.
+var dialect = struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	holders int
+	waiting [2]int
+}{}
+
+func init() {
+	dialect.cond.L = &dialect.mu
+}
+
+// withDialect calls f with resolve.AllowRecursion set as requested.
+func withDialect(allowRecursion bool, f func() error) error {
+	mode, other := 0, 1
+	if allowRecursion {
+		mode, other = 1, 0
+	}
+	dialect.mu.Lock()
+	for dialect.holders > 0 && (resolve.AllowRecursion != allowRecursion || dialect.waiting[other] > 0) {
+		dialect.waiting[mode]++
+		dialect.cond.Wait()
+		dialect.waiting[mode]--
+	}
+	if dialect.holders == 0 {
+		resolve.AllowRecursion = allowRecursion
+	}
+	dialect.holders++
+	dialect.mu.Unlock()
+
+	defer func() {
+		dialect.mu.Lock()
+		dialect.holders--
+		if dialect.holders == 0 {
+			resolve.AllowRecursion = false
+			dialect.cond.Broadcast()
+		}
+		dialect.mu.Unlock()
+	}()
+	return f()
+}
+
+// Program is a script that was parsed and resolved once, and may then be
+// run any number of times with different options.
+type Program struct {
+	label string
+	prog  *starlark.Program
+	// predeclared holds the first reference to each name that is
+	// expected to be in the namespace, in source order.
+	predeclared []*syntax.Ident
+	// loop holds the first while loop in the script, if any, which is
+	// only accepted when running with AllowRecursion.
+	loop *syntax.WhileStmt
+	// globals holds the first binding of each global name, and
+	// reassign the first binding of one that was already bound, if any.
+	// Both are only checked when running with StrictGlobals.
+	globals  []*syntax.Ident
+	reassign *syntax.Ident
+}
+
+// Compile parses and resolves the script in src. Names that are not
+// defined by the script itself must be provided when running it.
+func Compile(label, src string) (*Program, error) {
+	// While loops are accepted so that the same program may run with or
+	// without recursion, and are checked by run instead.
+	return compile(label, src, func(name string) bool {
+		return !starlark.Universe.Has(name)
+	}, true)
+}
+
+func compile(label string, src interface{}, isPredeclared func(name string) bool, allowLoops bool) (*Program, error) {
+	file, err := syntax.Parse(label, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	// The resolver only consults resolve.AllowRecursion for while loops,
+	// so scripts without them never wait for runs holding the dialect.
+	loop := findLoop(file)
+	var prog *starlark.Program
+	switch {
+	case loop == nil:
+		prog, err = starlark.FileProgram(file, isPredeclared)
+	case !allowLoops:
+		err = loopError(loop)
+	default:
+		err = withDialect(true, func() error {
+			var err error
+			prog, err = starlark.FileProgram(file, isPredeclared)
+			return err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	var predeclared, globals []*syntax.Ident
+	var reassign *syntax.Ident
+	seen := make(map[string]bool)
+	bind := func(id *syntax.Ident) {
+		binding, ok := id.Binding.(*resolve.Binding)
+		if !ok || binding.Scope != resolve.Global {
+			return
+		}
+		if binding.First == id {
+			globals = append(globals, id)
+		} else if reassign == nil {
+			reassign = id
+		}
+	}
+	var visit func(node syntax.Node) bool
+	visit = func(node syntax.Node) bool {
+		switch node := node.(type) {
+		case *syntax.WhileStmt:
+			// syntax.Walk does not know about while loops.
+			syntax.Walk(node.Cond, visit)
+			for _, stmt := range node.Body {
+				syntax.Walk(stmt, visit)
+			}
+			return false
+		case *syntax.AssignStmt:
+			bindTargets(node.LHS, bind)
+		case *syntax.ForStmt:
+			bindTargets(node.Vars, bind)
+		case *syntax.DefStmt:
+			bind(node.Name)
+		case *syntax.LoadStmt:
+			for _, id := range node.To {
+				bind(id)
+			}
+		case *syntax.Ident:
+			binding, ok := node.Binding.(*resolve.Binding)
+			if ok && binding.Scope == resolve.Predeclared && !seen[node.Name] {
+				seen[node.Name] = true
+				predeclared = append(predeclared, node)
+			}
+		}
+		return true
+	}
+	syntax.Walk(file, visit)
+	return &Program{
+		label:       label,
+		prog:        prog,
+		predeclared: predeclared,
+		loop:        loop,
+		globals:     globals,
+		reassign:    reassign,
+	}, nil
+}
+
+// findLoop returns the first while loop in file, if any.
+func findLoop(file *syntax.File) *syntax.WhileStmt {
+	var loop *syntax.WhileStmt
+	var visit func(node syntax.Node) bool
+	visit = func(node syntax.Node) bool {
+		if loop != nil {
+			return false
+		}
+		if node, ok := node.(*syntax.WhileStmt); ok {
+			// syntax.Walk does not know about while loops.
+			loop = node
+			return false
+		}
+		return true
+	}
+	syntax.Walk(file, visit)
+	return loop
+}
+
+// loopError returns the error reported for the while loop when running
+// without AllowRecursion, as the resolver reports it.
+func loopError(loop *syntax.WhileStmt) error {
+	return resolve.ErrorList{{Pos: loop.While, Msg: "dialect does not support while loops"}}
+}
+
+// bindTargets calls bind with the identifiers assigned by the expression
+// on the left side of an assignment or in a for clause.
+func bindTargets(expr syntax.Expr, bind func(id *syntax.Ident)) {
+	switch expr := expr.(type) {
+	case *syntax.Ident:
+		bind(expr)
+	case *syntax.ParenExpr:
+		bindTargets(expr.X, bind)
+	case *syntax.TupleExpr:
+		for _, x := range expr.List {
+			bindTargets(x, bind)
+		}
+	case *syntax.ListExpr:
+		for _, x := range expr.List {
+			bindTargets(x, bind)
+		}
+	}
+}
+
+// Run runs the program with the provided options. The Label and Script
+// options are ignored, as these were provided when compiling it.
+//
+// Runs behave exactly as with the Run function, which uses a program
+// as well. Unlike starlark.ExecFile, neither freezes the globals of the
+// script once it finishes, as they are discarded anyway and may hold
+// values from the namespace, such as content, that freezing would make
+// read-only for later runs.
+func (p *Program) Run(opts *RunOptions) error {
+	namespace, err := buildNamespace(opts)
+	if err != nil {
+		return err
+	}
+	return p.run(namespace, opts)
+}
+
+func (p *Program) run(namespace starlark.StringDict, opts *RunOptions) error {
+	// Checked in the same order as by compile when called by Run.
+	if p.loop != nil && !opts.AllowRecursion {
+		return loopError(p.loop)
+	}
+	for _, id := range p.predeclared {
+		if !namespace.Has(id.Name) {
+			// Reported as the resolver does when the namespace is
+			// known while compiling, as done by Run.
+			return resolve.ErrorList{{Pos: id.NamePos, Msg: "undefined: " + id.Name}}
+		}
+	}
+	if opts.StrictGlobals {
+		if id := p.reassign; id != nil {
+			first := id.Binding.(*resolve.Binding).First
+			return fmt.Errorf("%s: cannot reassign global %s declared at %s", id.NamePos, id.Name, first.NamePos)
+		}
+		for _, id := range p.globals {
+			if namespace.Has(id.Name) {
+				return fmt.Errorf("%s: cannot reassign predeclared %s", id.NamePos, id.Name)
+			}
+		}
+	}
+	thread := &starlark.Thread{Name: p.label, Load: opts.Load}
+	if !opts.FixedTime.IsZero() {
+		thread.SetLocal(fixedTimeKey, opts.FixedTime)
+	}
+	thread.SetLocal(stdoutKey, outputWriter(opts.Stdout))
+	thread.SetLocal(stderrKey, outputWriter(opts.Stderr))
+	thread.SetLocal(logLevelKey, opts.LogLevel)
+	for _, value := range namespace {
+		if c, ok := value.(*ContentValue); ok {
+			defer c.bindThread(thread)()
+		}
+	}
+	return withDialect(opts.AllowRecursion, func() error {
+		_, err := p.prog.Init(thread, namespace)
+		// The thread was cancelled if an iteration failed, so report
+		// why instead.
+		if ierr, ok := thread.Local(iterErrorKey).(error); ok {
+			err = ierr
+		}
+		if cerr := closeWriters(thread); err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
+
+// stdoutKey and stderrKey are the thread-local keys holding the writers
+// set in RunOptions.Stdout and RunOptions.Stderr.
+const (
+	stdoutKey = "scripts.stdout"
+	stderrKey = "scripts.stderr"
+)
+
+func outputWriter(w io.Writer) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
+
+// threadStdout returns the writer for standard output of the script
+// running in thread. Builtins must write there rather than to os.Stdout.
+func threadStdout(thread *starlark.Thread) io.Writer {
+	w, _ := thread.Local(stdoutKey).(io.Writer)
+	return outputWriter(w)
+}
+
+// threadStderr returns the writer for standard error of the script
+// running in thread. Builtins must write there rather than to os.Stderr.
+func threadStderr(thread *starlark.Thread) io.Writer {
+	w, _ := thread.Local(stderrKey).(io.Writer)
+	return outputWriter(w)
+}
+
+func buildNamespace(opts *RunOptions) (starlark.StringDict, error) {
+	err := validateNamespace(opts)
+	if err != nil {
+		return nil, err
+	}
+	namespace := make(starlark.StringDict, len(opts.Namespace)+len(opts.Contents)+len(opts.Constants))
+	for name, value := range CoreModule() {
+		namespace[name] = value
+	}
+	for name, value := range opts.Namespace {
+		namespace[name] = value
+	}
+	for name, content := range opts.Contents {
+		if _, ok := opts.Namespace[name]; ok {
+			return nil, fmt.Errorf("content name %q conflicts with namespace entry", name)
+		}
+		namespace[name] = content
+	}
+	for name, value := range opts.Constants {
+		_, inNamespace := opts.Namespace[name]
+		_, inContents := opts.Contents[name]
+		if inNamespace || inContents {
+			return nil, fmt.Errorf("constant name %q conflicts with namespace entry", name)
+		}
+		namespace[name] = starlark.String(value)
+	}
+	if opts.Content != nil {
+		_, inNamespace := opts.Namespace["content"]
+		_, inContents := opts.Contents["content"]
+		_, inConstants := opts.Constants["content"]
+		if inNamespace || inContents || inConstants {
+			return nil, fmt.Errorf("cannot provide Content with another entry named \"content\"")
+		}
+		namespace["content"] = opts.Content
+	}
+	return namespace, nil
+}
+
+// NamespaceError is returned when an entry provided to the namespace of
+// a script via RunOptions cannot be used.
+type NamespaceError struct {
+	Name   string
+	Reason string
+}
+
+func (e *NamespaceError) Error() string {
+	return fmt.Sprintf("invalid namespace entry %q: %s", e.Name, e.Reason)
+}
+
+// validateNamespace checks the names and values of the entries provided
+// in opts, in lexical order so that errors are deterministic.
+func validateNamespace(opts *RunOptions) error {
+	names := make([]string, 0, len(opts.Namespace)+len(opts.Contents)+len(opts.Constants))
+	for name := range opts.Namespace {
+		names = append(names, name)
+	}
+	for name := range opts.Contents {
+		names = append(names, name)
+	}
+	for name := range opts.Constants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !isIdentifier(name) {
+			return &NamespaceError{Name: name, Reason: "not a valid identifier"}
+		}
+		if value, ok := opts.Namespace[name]; ok && value == nil {
+			return &NamespaceError{Name: name, Reason: "value is nil"}
+		}
+		if content, ok := opts.Contents[name]; ok && content == nil {
+			return &NamespaceError{Name: name, Reason: "value is nil"}
+		}
+	}
+	return nil
+}
+
+// ContentNamespace returns a namespace holding the provided content under
+// name, ready to be used as RunOptions.Namespace.
+func ContentNamespace(name string, c *ContentValue) (map[string]Value, error) {
+	if !isIdentifier(name) {
+		return nil, &NamespaceError{Name: name, Reason: "not a valid identifier"}
+	}
+	if c == nil {
+		return nil, &NamespaceError{Name: name, Reason: "value is nil"}
+	}
+	return map[string]Value{name: c}, nil
+}
+
+// isIdentifier returns whether name may be referenced from scripts.
+func isIdentifier(name string) bool {
+	expr, err := syntax.ParseExpr("", name, 0)
+	if err != nil {
+		return false
+	}
+	id, ok := expr.(*syntax.Ident)
+	return ok && id.Name == name
 }
 
+// ContentValue gives scripts access to the filesystem tree under RootDir.
+// It is safe for concurrent use by multiple threads once configured, and
+// the callbacks are never invoked concurrently for a single value.
 type ContentValue struct {
 	RootDir    string
 	CheckRead  func(path string) error
 	CheckWrite func(path string) error
+	// OnWrite is called after every entry is written, with its path
+	// relative to RootDir. An error aborts the script. Directories are
+	// always reported before the entries inside them, so parents that
+	// are created along with an entry are reported first, outermost
+	// first, as needed by consumers such as archive writers.
+	OnWrite func(entry *fsutil.Entry) error
+	// OnRemove is called after every entry is removed, with its content
+	// path, which ends with a slash for directories. An error aborts
+	// the script.
+	OnRemove func(path string) error
+	// OnConflict, if set, is called by Content.write when the file to
+	// write already exists, with the entry found there and the one that
+	// would replace it, to decide whether to overwrite it. Skipped
+	// writes are not reported via OnWrite.
+	OnConflict func(path string, existing, incoming *fsutil.Entry) (Decision, error)
+	// If DryRun is true, changes are reported via the callbacks but
+	// the filesystem is left untouched. Reads observe the real content.
+	DryRun bool
+	// Audit, if set, is called after every method invoked by a script
+	// with the method name, the content path it was given, and the
+	// resulting error, so that failed operations are observed as well.
+	// Methods taking several paths report the one they write to, and
+	// host paths are never reported.
+	Audit func(op string, path string, err error)
+	// AllowImport is called with the absolute host path of every file
+	// a script attempts to copy into the content via Content.move_into,
+	// after resolving any symlinks, and an error prevents the import.
+	// That method is only available when this is set.
+	AllowImport func(hostPath string) error
+	// Umask holds permission bits that are cleared from the mode of
+	// files and directories created by scripts.
+	Umask fs.FileMode
+	// OpTimeout, if positive, bounds the time each read operation may
+	// block on the filesystem.
+	OpTimeout time.Duration
+	// ExposeRoot makes RootDir available to scripts as Content.root.
+	// It is hidden by default, as it reveals a host path.
+	ExposeRoot bool
+	// SymlinkMode defines how symlinks in content paths are handled.
+	SymlinkMode SymlinkMode
+	// Transform, if set, is called with the content path and the data
+	// of every file written by a script, and the data it returns is
+	// written instead. An error aborts the write. Content.open_write and
+	// Content.append_line are unavailable when this is set, as they
+	// write data in pieces.
+	Transform func(path string, data []byte) ([]byte, error)
+	// MaxWriteSize, if positive, is the maximum size in bytes of files
+	// written by scripts. Larger writes fail before the filesystem is
+	// touched.
+	MaxWriteSize int64
+	// If VerboseErrors is true, filesystem errors are reported as a
+	// *ContentPathError holding the host path as well, for logging.
+	VerboseErrors bool
+	// AllowChown makes Content.chown available to scripts. It's hidden
+	// by default, as changing ownership is a privileged operation.
+	AllowChown bool
+	// If RecordOwnership is true, Content.chown only reports the new
+	// ownership via OnWrite and leaves the filesystem untouched, for
+	// when ownership is kept as metadata rather than applied.
+	RecordOwnership bool
+	// ReadOnly hides all methods that change the content, so that
+	// scripts may only inspect it. Unlike a CheckWrite that denies
+	// everything, the methods are not even listed.
+	ReadOnly bool
+	// ListChunkSize is the number of entries read from a directory per
+	// system call when listing it. Larger values mean fewer calls on
+	// huge directories, at the cost of more memory held per call. It
+	// defaults to 16, and smaller values are raised to 4.
+	ListChunkSize int
+
+	mu     sync.Mutex
+	frozen atomic.Bool
+	closed atomic.Bool
+
+	// threads counts the runs using the value per thread, and parent is
+	// the value it was obtained from via Content.sub, if any. Both are
+	// used to report iteration errors, as documented in Iterate.
+	threadsMu sync.Mutex
+	threads   map[*starlark.Thread]int
+	parent    *ContentValue
 }
 
 // Content starlark.Value interface
@@ -46,15 +596,242 @@ func (c *ContentValue) Type() string {
 	return "Content"
 }
 
+// Freeze prevents further changes to the content via c. Methods that
+// only read the content remain available.
 func (c *ContentValue) Freeze() {
+	c.frozen.Store(true)
+}
+
+// Close releases the resources held by c, which may not be used anymore
+// afterwards. A closed value is frozen as well, and all of its methods
+// fail except for close itself. Values previously obtained from it via
+// Content.sub are not affected. Closing it again does nothing. Scripts
+// may close the value via Content.close as well, so a value shared by
+// several scripts is closed for all of them at once.
+func (c *ContentValue) Close() error {
+	c.Freeze()
+	c.closed.Store(true)
+	return nil
 }
 
 func (c *ContentValue) Truth() starlark.Bool {
 	return true
 }
 
+// Hash fails, as content values are handles to a filesystem tree under a
+// set of policies, and compare equal only to themselves. Hashing by
+// RootDir would have distinct values with different policies collide, so
+// they cannot be used as dictionary keys or set members.
 func (c *ContentValue) Hash() (uint32, error) {
-	return starlark.String(c.RootDir).Hash()
+	return 0, fmt.Errorf("unhashable type: Content")
+}
+
+// Content starlark.Iterable interface
+// --------------------------------------------------------------------------
+
+var _ starlark.Iterable = new(ContentValue)
+
+// Iterate iterates over the names of the entries in the root directory,
+// in the same form as Content.list("/") returns them. The directory is
+// read lazily in chunks of ListChunkSize entries, so names come in the
+// order the filesystem returns them rather than sorted as by list, and
+// scripts wanting that order may use sorted(content) instead.
+//
+// As the interface offers no way to report errors, a failure to read the
+// directory cancels the thread of the run using the value, which then
+// fails with that error. When no single run is using it, such as when it
+// is shared by concurrent runs, the whole directory is read up front
+// instead, and the value is not iterable if that fails, so that names are
+// never cut short silently. Errors are reported to Audit in every case.
+func (c *ContentValue) Iterate() starlark.Iterator {
+	it := &contentIterator{c: c, thread: c.runThread()}
+	err := it.open()
+	if err != nil {
+		it.fail(err)
+	}
+	if it.thread == nil {
+		for it.file != nil {
+			it.readChunk()
+		}
+		if it.err != nil {
+			it.Done()
+			return nil
+		}
+	}
+	return it
+}
+
+// contentIterator yields the names of the entries in the root directory
+// of c, reading them from file one chunk at a time.
+type contentIterator struct {
+	c      *ContentValue
+	thread *starlark.Thread
+	fpath  string
+	file   *os.File
+	names  []string
+	err    error
+	done   bool
+}
+
+func (it *contentIterator) open() error {
+	if it.c.closed.Load() {
+		return errContentClosed
+	}
+	fpath, err := it.c.RealPath("/", CheckRead)
+	if err != nil {
+		return err
+	}
+	file, done, err := it.c.openFile(fpath, "readdir")
+	if err != nil {
+		return it.c.polishError("/", err)
+	}
+	// The timeout applies to each chunk read rather than to the whole
+	// iteration, which lasts as long as the script takes.
+	done(nil)
+	it.fpath = fpath
+	it.file = file
+	return nil
+}
+
+func (it *contentIterator) Next(p *Value) bool {
+	for len(it.names) == 0 {
+		if it.file == nil {
+			return false
+		}
+		it.readChunk()
+	}
+	*p = starlark.String(it.names[0])
+	it.names = it.names[1:]
+	return true
+}
+
+// readChunk reads the names of the next chunk of entries, releasing the
+// directory once all were read, or failing the iteration.
+func (it *contentIterator) readChunk() {
+	done := it.c.watchFile(it.file, it.fpath, "readdir")
+	entries, err := it.file.ReadDir(it.c.listChunkSize())
+	if err == io.EOF {
+		err = nil
+		it.file.Close()
+		it.file = nil
+	}
+	if err = done(err); err != nil {
+		it.fail(it.c.polishError("/", err))
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		it.names = append(it.names, name)
+	}
+}
+
+// fail stops the iteration with err, which is reported to the run using
+// the value, if any, as documented in Iterate.
+func (it *contentIterator) fail(err error) {
+	it.err = err
+	it.names = nil
+	if it.file != nil {
+		it.file.Close()
+		it.file = nil
+	}
+	if it.thread != nil {
+		it.thread.SetLocal(iterErrorKey, err)
+		it.thread.Cancel(err.Error())
+	}
+}
+
+// Done releases the directory if the iteration was abandoned, and
+// reports the outcome to Audit.
+func (it *contentIterator) Done() {
+	if it.done {
+		return
+	}
+	it.done = true
+	if it.file != nil {
+		it.file.Close()
+		it.file = nil
+	}
+	if it.c.Audit != nil {
+		it.c.audit("iterate", "/", it.err)
+	}
+}
+
+// iterErrorKey is the thread-local key holding the error that stopped
+// the iteration over a content value, as documented in Iterate.
+const iterErrorKey = "scripts.itererror"
+
+// bindThread records that thread runs a script using c, until the
+// returned function is called.
+func (c *ContentValue) bindThread(thread *starlark.Thread) (unbind func()) {
+	c.threadsMu.Lock()
+	defer c.threadsMu.Unlock()
+	if c.threads == nil {
+		c.threads = make(map[*starlark.Thread]int)
+	}
+	c.threads[thread]++
+	return func() {
+		c.threadsMu.Lock()
+		defer c.threadsMu.Unlock()
+		c.threads[thread]--
+		if c.threads[thread] == 0 {
+			delete(c.threads, thread)
+		}
+	}
+}
+
+// runThread returns the thread of the only run using c or the value it
+// was obtained from via Content.sub, or nil if there is no such run or
+// there are several of them.
+func (c *ContentValue) runThread() *starlark.Thread {
+	for v := c; v != nil; v = v.parent {
+		v.threadsMu.Lock()
+		var thread *starlark.Thread
+		for t := range v.threads {
+			thread = t
+		}
+		n := len(v.threads)
+		v.threadsMu.Unlock()
+		if n == 1 {
+			return thread
+		}
+		if n > 1 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Content starlark.HasBinary interface
+// --------------------------------------------------------------------------
+
+var _ starlark.HasBinary = new(ContentValue)
+
+// Binary implements the "in" operator, reporting whether an entry exists
+// at the content path on the left side. The entry itself is checked, so a
+// symlink exists even if its target does not.
+func (c *ContentValue) Binary(op syntax.Token, y Value, side starlark.Side) (Value, error) {
+	if op != syntax.IN || side != starlark.Right {
+		return nil, nil
+	}
+	path, ok := y.(starlark.String)
+	if !ok {
+		return nil, fmt.Errorf("'in Content' requires string as left operand, not %s", y.Type())
+	}
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Lstat(fpath)
+	if os.IsNotExist(err) {
+		return starlark.False, nil
+	}
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.True, nil
 }
 
 // Content starlark.HasAttrs interface
@@ -62,20 +839,286 @@ func (c *ContentValue) Hash() (uint32, error) {
 
 var _ starlark.HasAttrs = new(ContentValue)
 
-func (c *ContentValue) Attr(name string) (Value, error) {
+type contentMethod func(c *ContentValue, thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error)
+
+var contentMethods = map[string]contentMethod{
+	"read":          (*ContentValue).Read,
+	"write":         (*ContentValue).Write,
+	"list":          (*ContentValue).List,
+	"du":            (*ContentValue).DiskUsage,
+	"find":          (*ContentValue).Find,
+	"glob_count":    (*ContentValue).GlobCount,
+	"sub":           (*ContentValue).sub,
+	"write_json":    (*ContentValue).WriteJSON,
+	"read_json":     (*ContentValue).ReadJSON,
+	"open_write":    (*ContentValue).OpenWrite,
+	"read_lines":    (*ContentValue).ReadLines,
+	"readall":       (*ContentValue).ReadAll,
+	"grep":          (*ContentValue).Grep,
+	"mktemp":        (*ContentValue).MakeTemp,
+	"mkdtemp":       (*ContentValue).MakeTemp,
+	"with_tempdir":  (*ContentValue).WithTempDir,
+	"touch":         (*ContentValue).Touch,
+	"set_times":     (*ContentValue).SetTimes,
+	"chown":         (*ContentValue).Chown,
+	"truncate":      (*ContentValue).Truncate,
+	"readdir":       (*ContentValue).ReadDir,
+	"move_into":     (*ContentValue).MoveInto,
+	"hardlink":      (*ContentValue).Hardlink,
+	"copy_tree":     (*ContentValue).CopyTree,
+	"count":         (*ContentValue).Count,
+	"replace":       (*ContentValue).Replace,
+	"lstat":         (*ContentValue).Lstat,
+	"is_dir":        (*ContentValue).IsType,
+	"is_file":       (*ContentValue).IsType,
+	"is_empty":      (*ContentValue).IsEmpty,
+	"resolve":       (*ContentValue).Resolve,
+	"normpath":      (*ContentValue).NormPath,
+	"mkdir":         (*ContentValue).Mkdir,
+	"compare":       (*ContentValue).Compare,
+	"diff":          (*ContentValue).Diff,
+	"walk":          (*ContentValue).Walk,
+	"close":         (*ContentValue).close,
+	"ensure_dir":    (*ContentValue).EnsureDir,
+	"move":          (*ContentValue).Move,
+	"verify":        (*ContentValue).Verify,
+	"append_line":   (*ContentValue).AppendLine,
+	"by_extension":  (*ContentValue).ByExtension,
+	"newer_than":    (*ContentValue).NewerThan,
+	"checksum_tree": (*ContentValue).ChecksumTree,
+	"list_page":     (*ContentValue).ListPage,
+	"glob_stat":     (*ContentValue).GlobStat,
+}
+
+func init() {
+	// Content.help lists the methods, so it cannot be in the literal.
+	contentMethods["help"] = (*ContentValue).Help
+	for name := range contentMethods {
+		contentMethodNames = append(contentMethodNames, name)
+	}
+	sort.Strings(contentMethodNames)
+}
+
+// contentMethodParams holds the parameters of each method for Content.help,
+// in the notation of starlark.UnpackArgs, where optional ones end with "?".
+var contentMethodParams = map[string]string{
+	"read":          "path, default?",
+	"write":         "path, data, make_parents?, exclusive?",
+	"list":          "path, files_only?, dirs_only?, pattern?",
+	"du":            "path, follow_symlinks?",
+	"find":          "path, predicate, maxdepth?",
+	"glob_count":    "pattern",
+	"sub":           "path",
+	"write_json":    "path, value, indent?",
+	"read_json":     "path, max_size?",
+	"open_write":    "path, atomic?",
+	"read_lines":    "path, keepends?",
+	"readall":       "path, max_total_size?",
+	"grep":          "path, pattern, regex?",
+	"mktemp":        "dir?, prefix?",
+	"mkdtemp":       "dir?, prefix?",
+	"with_tempdir":  "fn, dir?, prefix?",
+	"touch":         "path, mtime?",
+	"set_times":     "path, mtime, atime?, recursive?",
+	"chown":         "path, uid, gid",
+	"truncate":      "path, size?",
+	"readdir":       "path",
+	"move_into":     "host_path, path",
+	"hardlink":      "target, path, force?",
+	"copy_tree":     "src, dst, exclude?",
+	"count":         "path",
+	"replace":       "path, old, new, count?, required?",
+	"lstat":         "path",
+	"is_dir":        "path, follow_symlinks?",
+	"is_file":       "path, follow_symlinks?",
+	"is_empty":      "path",
+	"resolve":       "path",
+	"normpath":      "path",
+	"mkdir":         "path, make_parents?",
+	"compare":       "path_a, path_b",
+	"diff":          "path, other?, data?",
+	"walk":          "path, fn, maxdepth?",
+	"help":          "",
+	"close":         "",
+	"ensure_dir":    "path",
+	"move":          "src, dst",
+	"verify":        "path, expected, algo?, required?",
+	"append_line":   "path, line, unique?",
+	"by_extension":  "path, ext, ignore_case?",
+	"newer_than":    "path_a, path_b",
+	"checksum_tree": "path, algo?",
+	"list_page":     "path, cursor?, limit?",
+	"glob_stat":     "pattern",
+}
+
+// contentAuditParams holds the parameter of each method with the content
+// path reported to Audit, which is the written one for methods taking
+// several paths. Methods operating on no path are left out.
+var contentAuditParams = map[string]string{
+	"read":          "path",
+	"write":         "path",
+	"list":          "path",
+	"du":            "path",
+	"find":          "path",
+	"glob_count":    "pattern",
+	"sub":           "path",
+	"write_json":    "path",
+	"read_json":     "path",
+	"open_write":    "path",
+	"read_lines":    "path",
+	"readall":       "path",
+	"grep":          "path",
+	"mktemp":        "dir",
+	"mkdtemp":       "dir",
+	"with_tempdir":  "dir",
+	"touch":         "path",
+	"set_times":     "path",
+	"chown":         "path",
+	"truncate":      "path",
+	"readdir":       "path",
+	"move_into":     "path",
+	"hardlink":      "path",
+	"copy_tree":     "dst",
+	"count":         "path",
+	"replace":       "path",
+	"lstat":         "path",
+	"is_dir":        "path",
+	"is_file":       "path",
+	"is_empty":      "path",
+	"resolve":       "path",
+	"normpath":      "path",
+	"mkdir":         "path",
+	"compare":       "path_a",
+	"diff":          "path",
+	"walk":          "path",
+	"ensure_dir":    "path",
+	"move":          "dst",
+	"verify":        "path",
+	"append_line":   "path",
+	"by_extension":  "path",
+	"newer_than":    "path_a",
+	"checksum_tree": "path",
+	"list_page":     "path",
+	"glob_stat":     "pattern",
+}
+
+// contentWriteMethods holds the names of methods that change the content.
+var contentWriteMethods = map[string]bool{
+	"write":        true,
+	"write_json":   true,
+	"open_write":   true,
+	"mktemp":       true,
+	"mkdtemp":      true,
+	"with_tempdir": true,
+	"touch":        true,
+	"set_times":    true,
+	"chown":        true,
+	"truncate":     true,
+	"move_into":    true,
+	"hardlink":     true,
+	"copy_tree":    true,
+	"replace":      true,
+	"mkdir":        true,
+	"ensure_dir":   true,
+	"move":         true,
+	"append_line":  true,
+}
+
+var errContentClosed = errors.New("cannot use closed Content")
+
+// contentMethodNames holds the sorted names in contentMethods.
+var contentMethodNames []string
+
+// hasMethod returns whether the named method is available in c, as some
+// methods are only provided when their respective policy is configured.
+func (c *ContentValue) hasMethod(name string) bool {
+	if c.ReadOnly && contentWriteMethods[name] {
+		return false
+	}
 	switch name {
-	case "read":
-		return starlark.NewBuiltin("Content.read", c.Read), nil
-	case "write":
-		return starlark.NewBuiltin("Content.write", c.Write), nil
-	case "list":
-		return starlark.NewBuiltin("Content.list", c.List), nil
+	case "move_into":
+		return c.AllowImport != nil
+	case "chown":
+		return c.AllowChown
+	case "open_write", "append_line":
+		return c.Transform == nil
 	}
-	return nil, nil
+	_, ok := contentMethods[name]
+	return ok
+}
+
+func (c *ContentValue) Attr(name string) (Value, error) {
+	if name == "root" {
+		if c.ExposeRoot {
+			return starlark.String(c.RootDir), nil
+		}
+		return nil, nil
+	}
+	if !c.hasMethod(name) {
+		return nil, nil
+	}
+	method := contentMethods[name]
+	return starlark.NewBuiltin("Content."+name, func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+		var result Value
+		var err error
+		if name != "close" && c.closed.Load() {
+			err = errContentClosed
+		} else if contentWriteMethods[name] && c.frozen.Load() {
+			err = fmt.Errorf("cannot write to frozen Content")
+		} else {
+			result, err = method(c, thread, fn, args, kwargs)
+		}
+		if c.Audit != nil {
+			c.audit(name, auditPath(name, args, kwargs), err)
+		}
+		return result, err
+	}), nil
 }
 
 func (c *ContentValue) AttrNames() []string {
-	return []string{"read", "write", "list"}
+	names := make([]string, 0, len(contentMethodNames)+1)
+	for _, name := range contentMethodNames {
+		if c.hasMethod(name) {
+			names = append(names, name)
+		}
+	}
+	if c.ExposeRoot {
+		names = append(names, "root")
+		sort.Strings(names)
+	}
+	return names
+}
+
+// auditPath returns the content path provided to the named method via
+// its parameter in contentAuditParams, if any.
+func auditPath(name string, args starlark.Tuple, kwargs []starlark.Tuple) string {
+	param, ok := contentAuditParams[name]
+	if !ok {
+		return ""
+	}
+	for i, p := range strings.Split(contentMethodParams[name], ", ") {
+		if strings.TrimSuffix(p, "?") == param && i < len(args) {
+			path, _ := starlark.AsString(args[i])
+			return path
+		}
+	}
+	for _, kwarg := range kwargs {
+		if kwarg[0] == starlark.String(param) {
+			path, _ := starlark.AsString(kwarg[1])
+			return path
+		}
+	}
+	if param == "dir" {
+		// Temporary entries are created under the root by default.
+		return "/"
+	}
+	return ""
+}
+
+func (c *ContentValue) audit(op string, path string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Audit(op, path, err)
 }
 
 // Content methods
@@ -89,40 +1132,88 @@ const (
 	CheckWrite
 )
 
+// SymlinkMode defines how a ContentValue handles symlinks in the content
+// paths provided by scripts.
+type SymlinkMode int
+
+const (
+	// FollowWithinRoot follows symlinks at the end of content paths as
+	// long as their targets remain under the content root.
+	FollowWithinRoot SymlinkMode = iota
+	// NeverFollow operates on symlinks at the end of content paths
+	// themselves: reading them fails, and writing replaces them.
+	NeverFollow
+	// Reject fails on any content path that has a symlink in one of
+	// its components.
+	Reject
+)
+
+// PermissionError is returned when CheckRead or CheckWrite deny access to
+// a content path, and holds the error returned by the check. It allows
+// telling operations forbidden by policy apart from filesystem errors.
+type PermissionError struct {
+	Path string
+	Err  error
+}
+
+func (e *PermissionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
 func (c *ContentValue) RealPath(path string, what Check) (string, error) {
+	return c.realPath(path, what, 0)
+}
+
+func (c *ContentValue) realPath(path string, what Check, links int) (string, error) {
 	if !filepath.IsAbs(c.RootDir) {
 		return "", fmt.Errorf("internal error: content defined with relative root: %s", c.RootDir)
 	}
 	if !filepath.IsAbs(path) {
 		return "", fmt.Errorf("content path must be absolute, got: %s", path)
 	}
-	cpath := filepath.Clean(path)
-	if cpath != "/" && strings.HasSuffix(path, "/") {
-		cpath += "/"
-	}
-	if c.CheckRead != nil && what&CheckRead != 0 {
-		err := c.CheckRead(cpath)
-		if err != nil {
-			return "", err
-		}
+	// Paths with .. components are rejected even if they stay under
+	// the root once cleaned, so that checks never have to reason about
+	// them.
+	err := checkDotDot(path)
+	if err != nil {
+		return "", err
 	}
-	if c.CheckWrite != nil && what&CheckWrite != 0 {
-		err := c.CheckWrite(cpath)
-		if err != nil {
-			return "", err
-		}
+	cpath := cleanPath(path)
+	err = c.check(cpath, what)
+	if err != nil {
+		return "", err
 	}
 	rpath := filepath.Join(c.RootDir, path)
 	if !filepath.IsAbs(rpath) || rpath != c.RootDir && !strings.HasPrefix(rpath, c.RootDir+string(filepath.Separator)) {
 		return "", fmt.Errorf("invalid content path: %s", path)
 	}
+	switch c.SymlinkMode {
+	case NeverFollow:
+		return rpath, nil
+	case Reject:
+		for cur := rpath; len(cur) > len(c.RootDir); cur = filepath.Dir(cur) {
+			info, err := os.Lstat(cur)
+			if err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				rel, _ := filepath.Rel(c.RootDir, cur)
+				return "", fmt.Errorf("content path has symlink: /%s", rel)
+			}
+		}
+		return rpath, nil
+	}
 	if lname, err := os.Readlink(rpath); err == nil {
 		lpath := filepath.Join(filepath.Dir(rpath), lname)
 		lrel, err := filepath.Rel(c.RootDir, lpath)
 		if err != nil || !filepath.IsAbs(lpath) || lpath != c.RootDir && !strings.HasPrefix(lpath, c.RootDir+string(filepath.Separator)) {
 			return "", fmt.Errorf("invalid content symlink: %s", path)
 		}
-		_, err = c.RealPath("/"+lrel, what)
+		if links == maxSymlinks {
+			return "", &os.PathError{Op: "resolve", Path: path, Err: syscall.ELOOP}
+		}
+		_, err = c.realPath("/"+lrel, what, links+1)
 		if err != nil {
 			return "", err
 		}
@@ -130,60 +1221,576 @@ func (c *ContentValue) RealPath(path string, what Check) (string, error) {
 	return rpath, nil
 }
 
-func (c *ContentValue) polishError(path starlark.String, err error) error {
-	if e, ok := err.(*os.PathError); ok {
-		e.Path = path.GoString()
+// replaceSymlink removes the symlink at the real path fpath in the
+// NeverFollow mode, so that writing there does not affect its target.
+func (c *ContentValue) replaceSymlink(fpath string) error {
+	if c.SymlinkMode != NeverFollow {
+		return nil
 	}
-	return err
+	info, err := os.Lstat(fpath)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(fpath)
 }
 
-func (c *ContentValue) Read(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+func (c *ContentValue) reportConflict(existing, incoming *fsutil.Entry) (Decision, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.OnConflict(existing.Path, existing, incoming)
+}
+
+func (c *ContentValue) reportRemove(path string) error {
+	if c.OnRemove == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.OnRemove(path)
+}
+
+func (c *ContentValue) reportWrite(entry *fsutil.Entry) error {
+	if c.OnWrite == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.OnWrite(entry)
+}
+
+// polishError replaces the host path in err with the content path seen
+// by the script, or wraps err in a *ContentPathError that keeps both if
+// VerboseErrors is set.
+func (c *ContentValue) polishError(path starlark.String, err error) error {
+	if e, ok := err.(*os.PathError); ok {
+		if c.VerboseErrors {
+			return &ContentPathError{Path: path.GoString(), Err: e}
+		}
+		e.Path = path.GoString()
+	}
+	return err
+}
+
+// ContentPathError is returned in place of an *os.PathError when the
+// content has VerboseErrors set. Its message refers to the content path
+// as seen by the script, while Err retains the host path.
+type ContentPathError struct {
+	Path string
+	Err  *os.PathError
+}
+
+func (e *ContentPathError) Error() string {
+	return e.Err.Op + " " + e.Path + ": " + e.Err.Err.Error()
+}
+
+func (e *ContentPathError) Unwrap() error {
+	return e.Err
+}
+
+// writeError polishes err as polishError does, and wraps it in a
+// *WriteError for path.
+func (c *ContentValue) writeError(path starlark.String, err error) error {
+	return &WriteError{Path: filepath.Clean(path.GoString()), Err: c.polishError(path, err)}
+}
+
+// WriteError is returned when the filesystem fails to create or write an
+// entry for a content path.
+type WriteError struct {
+	Path string
+	Err  error
+}
+
+func (e *WriteError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// IsNoSpace returns whether the write failed because the filesystem ran
+// out of space or the disk quota was exceeded.
+func (e *WriteError) IsNoSpace() bool {
+	return errors.Is(e.Err, syscall.ENOSPC) || errors.Is(e.Err, syscall.EDQUOT)
+}
+
+// check runs the requested checks on the clean content path cpath.
+func (c *ContentValue) check(cpath string, what Check) error {
+	if c.CheckRead != nil && what&CheckRead != 0 {
+		err := c.CheckRead(cpath)
+		if err != nil {
+			return &PermissionError{Path: cpath, Err: err}
+		}
+	}
+	if c.CheckWrite != nil && what&CheckWrite != 0 {
+		err := c.CheckWrite(cpath)
+		if err != nil {
+			return &PermissionError{Path: cpath, Err: err}
+		}
+	}
+	return nil
+}
+
+// checkDotDot fails if the content path has any .. components.
+func checkDotDot(path string) error {
+	for _, name := range strings.Split(path, "/") {
+		if name == ".." {
+			return fmt.Errorf("invalid content path: %s", path)
+		}
+	}
+	return nil
+}
+
+// cleanPath returns the clean form of the absolute content path,
+// preserving the trailing slash that marks directories.
+func cleanPath(path string) string {
+	cpath := filepath.Clean(path)
+	if cpath != "/" && strings.HasSuffix(path, "/") {
+		cpath += "/"
+	}
+	return cpath
+}
+
+// NormPath returns the canonical content path for path, as other methods
+// take it, without touching the filesystem. Relative paths are taken as
+// relative to the content root. Paths with .. components are rejected,
+// as done by all other methods.
+func (c *ContentValue) NormPath(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
 	var path starlark.String
-	err := starlark.UnpackArgs("Content.read", args, kwargs, "path", &path)
+	err := starlark.UnpackArgs("Content.normpath", args, kwargs, "path", &path)
 	if err != nil {
 		return nil, err
 	}
-
-	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	npath := path.GoString()
+	err = checkDotDot(npath)
 	if err != nil {
 		return nil, err
 	}
-	data, err := os.ReadFile(fpath)
+	if !filepath.IsAbs(npath) {
+		npath = "/" + npath
+	}
+	return starlark.String(cleanPath(npath)), nil
+}
+
+// dirPath returns the content path of a directory in canonical form,
+// cleaned and ending with a slash. Relative paths are not cleaned, so
+// that errors mention them as provided.
+func dirPath(dir string) string {
+	if filepath.IsAbs(dir) {
+		dir = filepath.Clean(dir)
+	}
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	return dir
+}
+
+// walkDir calls fn for every entry found under the content directory dir,
+// descending into subdirectories unless fn returns fs.SkipDir for them.
+// Paths given to fn are content paths, with a trailing slash for
+// directories. Every directory is checked for reading before being
+// listed, as done by Content.list. Symlinks are never followed.
+func (c *ContentValue) walkDir(dir string, fn func(path string, entry fs.DirEntry) error) error {
+	dir = dirPath(dir)
+	fpath, err := c.RealPath(dir, CheckRead)
+	if err != nil {
+		return err
+	}
+	entries, err := c.readDir(starlark.String(dir), fpath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := dir + entry.Name()
+		if entry.IsDir() {
+			path += "/"
+		}
+		err := fn(path, entry)
+		if err == fs.SkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			err = c.walkDir(path, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openFile opens the file at the real path fpath. If OpTimeout is set and
+// the returned done function is not called within that time, the file is
+// closed so that pending operations on it are interrupted. The done
+// function must be called with the error of those operations, and returns
+// the error to report in its place, which for interrupted operations is an
+// *os.PathError wrapping os.ErrDeadlineExceeded.
+func (c *ContentValue) openFile(fpath string, op string) (file *os.File, done func(err error) error, err error) {
+	flags := os.O_RDONLY
+	if c.SymlinkMode == NeverFollow {
+		flags |= syscall.O_NOFOLLOW
+	}
+	file, err = os.OpenFile(fpath, flags, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, c.watchFile(file, fpath, op), nil
+}
+
+// watchFile closes file if the returned done function is not called
+// within OpTimeout, as documented in openFile. It may be used again for
+// further operations once done was called.
+func (c *ContentValue) watchFile(file *os.File, fpath string, op string) (done func(err error) error) {
+	if c.OpTimeout <= 0 {
+		return func(err error) error { return err }
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.OpTimeout)
+	stop := context.AfterFunc(ctx, func() {
+		file.Close()
+	})
+	return func(err error) error {
+		stopped := stop()
+		cancel()
+		// Only errors caused by the file being closed on expiration
+		// are timeouts. Other errors may have happened before that.
+		if !stopped && errors.Is(err, os.ErrClosed) {
+			return &os.PathError{Op: op, Path: fpath, Err: os.ErrDeadlineExceeded}
+		}
+		return err
+	}
+}
+
+func (c *ContentValue) readFile(path starlark.String, fpath string) ([]byte, error) {
+	file, done, err := c.openFile(fpath, "read")
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return data, nil
+}
+
+const (
+	defaultListChunkSize = 16
+	minListChunkSize     = 4
+)
+
+func (c *ContentValue) listChunkSize() int {
+	switch {
+	case c.ListChunkSize == 0:
+		return defaultListChunkSize
+	case c.ListChunkSize < minListChunkSize:
+		return minListChunkSize
+	}
+	return c.ListChunkSize
+}
+
+// readDir returns the entries in the directory at the real path fpath,
+// sorted by name.
+func (c *ContentValue) readDir(path starlark.String, fpath string) ([]fs.DirEntry, error) {
+	file, done, err := c.openFile(fpath, "readdir")
 	if err != nil {
 		return nil, c.polishError(path, err)
 	}
-	return starlark.String(data), nil
+	defer file.Close()
+	// Reading in chunks bounds the memory used by each system call.
+	var entries []fs.DirEntry
+	for {
+		var chunk []fs.DirEntry
+		chunk, err = file.ReadDir(c.listChunkSize())
+		entries = append(entries, chunk...)
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (c *ContentValue) Read(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var fallback Value
+	err := starlark.UnpackArgs("Content.read", args, kwargs, "path", &path, "default?", &fallback)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fallback.(starlark.String); fallback != nil && !ok {
+		return nil, fmt.Errorf("Content.read: for parameter default: got %s, want string", fallback.Type())
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err == nil {
+		var data []byte
+		data, err = c.readFile(path, fpath)
+		if err == nil {
+			return starlark.String(data), nil
+		}
+	}
+	if fallback != nil && errors.Is(err, fs.ErrNotExist) {
+		return fallback, nil
+	}
+	return nil, err
 }
 
 func (c *ContentValue) Write(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
 	var path starlark.String
 	var data starlark.String
-	err := starlark.UnpackArgs("Content.write", args, kwargs, "path", &path, "data", &data)
+	var makeParents, exclusive bool
+	err := starlark.UnpackArgs("Content.write", args, kwargs, "path", &path, "data", &data, "make_parents?", &makeParents, "exclusive?", &exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	if makeParents {
+		err = c.makeDirs(filepath.Dir(path.GoString()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.OnConflict != nil && !exclusive {
+		existing, err := c.checkConflict(path, data.GoString())
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return NewEntryValue(existing), nil
+		}
+	}
+	// No mode parameter for now as slices are supposed to list files
+	// explicitly instead.
+	entry, err := c.createFile(path, strings.NewReader(data.GoString()), 0644, exclusive)
 	if err != nil {
 		return nil, err
 	}
+	return NewEntryValue(entry), nil
+}
+
+// Decision is returned by ContentValue.OnConflict to tell what to do about
+// a write over an existing file.
+type Decision int
 
+const (
+	// Overwrite replaces the existing file, as done when OnConflict is
+	// not set.
+	Overwrite Decision = iota
+	// Skip leaves the existing file alone, and the write succeeds
+	// returning its entry.
+	Skip
+	// Abort fails the write.
+	Abort
+)
+
+// checkConflict consults OnConflict if a file exists at path, and returns
+// its entry if the write of data there must be skipped.
+func (c *ContentValue) checkConflict(path starlark.String, data string) (*fsutil.Entry, error) {
 	fpath, err := c.RealPath(path.GoString(), CheckWrite)
 	if err != nil {
 		return nil, err
 	}
-	fdata := []byte(data.GoString())
+	info, err := os.Stat(fpath)
+	if os.IsNotExist(err) || err == nil && info.IsDir() {
+		// Writing fails on directories anyway.
+		return nil, nil
+	}
+	existing, err := c.statEntry(path.GoString(), fpath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(data))
+	incoming := &fsutil.Entry{
+		Path: existing.Path,
+		Mode: 0644 &^ c.Umask,
+		Hash: hex.EncodeToString(sum[:]),
+		Size: len(data),
+	}
+	decision, err := c.reportConflict(existing, incoming)
+	if err != nil {
+		return nil, err
+	}
+	switch decision {
+	case Overwrite:
+		return nil, nil
+	case Skip:
+		return existing, nil
+	case Abort:
+		return nil, fmt.Errorf("cannot overwrite existing file: %s", existing.Path)
+	}
+	return nil, fmt.Errorf("internal error: invalid conflict decision %d", decision)
+}
 
-	// No mode parameter for now as slices are supposed to list files
-	// explicitly instead.
-	err = os.WriteFile(fpath, fdata, 0644)
+// writeFile writes the data read from r into the file at the content path
+// and reports the resulting entry via OnWrite. Data is streamed, so callers
+// moving content around never need to hold it all in memory.
+func (c *ContentValue) writeFile(path starlark.String, r io.Reader) (*fsutil.Entry, error) {
+	return c.createFile(path, r, 0644, false)
+}
+
+// createFile is like writeFile, but the file is created with the given
+// mode, subject to Umask, and if exclusive is true it fails when an entry
+// already exists at path instead of truncating it.
+func (c *ContentValue) createFile(path starlark.String, r io.Reader, mode fs.FileMode, exclusive bool) (*fsutil.Entry, error) {
+	fpath, err := c.RealPath(path.GoString(), CheckWrite)
 	if err != nil {
-		return nil, c.polishError(path, err)
+		return nil, err
 	}
-	return starlark.None, nil
+	if c.Transform != nil {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, c.polishError(path, err)
+		}
+		data, err = c.Transform(filepath.Clean(path.GoString()), data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot transform %s: %w", path.GoString(), err)
+		}
+		r = bytes.NewReader(data)
+	}
+	// Readers of unknown size are checked by the caller.
+	if data, ok := r.(interface{ Len() int }); ok {
+		err = c.checkWriteSize(path, int64(data.Len()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mode &^= c.Umask
+	if !c.DryRun {
+		err = c.replaceSymlink(fpath)
+		if err != nil {
+			return nil, c.writeError(path, err)
+		}
+	}
+	var entry *fsutil.Entry
+	if c.DryRun {
+		if exclusive {
+			_, err := os.Lstat(fpath)
+			if err == nil {
+				err = &os.PathError{Op: "open", Path: fpath, Err: syscall.EEXIST}
+			}
+			if !os.IsNotExist(err) {
+				return nil, c.writeError(path, err)
+			}
+		}
+		h := sha256.New()
+		size, err := io.Copy(h, r)
+		if err != nil {
+			return nil, c.polishError(path, err)
+		}
+		entry = &fsutil.Entry{
+			Mode: mode,
+			Hash: hex.EncodeToString(h.Sum(nil)),
+			Size: int(size),
+		}
+	} else {
+		entry, err = fsutil.Create(&fsutil.CreateOptions{
+			Path:      fpath,
+			Mode:      mode,
+			Data:      r,
+			Exclusive: exclusive,
+		})
+		if err != nil {
+			return nil, c.writeError(path, err)
+		}
+	}
+	entry.Path = filepath.Clean(path.GoString())
+	err = c.reportWrite(entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// checkWriteSize fails if a file of the given size cannot be written at
+// path due to MaxWriteSize.
+func (c *ContentValue) checkWriteSize(path starlark.String, size int64) error {
+	if c.MaxWriteSize > 0 && size > c.MaxWriteSize {
+		return fmt.Errorf("write exceeds maximum size of %d bytes: %s", c.MaxWriteSize, path.GoString())
+	}
+	return nil
 }
 
+// List returns the names of the entries in the directory at the given
+// path, in lexical order. Names of directories end with a slash. With
+// files_only or dirs_only set, only regular files or directories are
+// respectively listed. With pattern set, only entries with names
+// matching it as done by filepath.Match are listed.
 func (c *ContentValue) List(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path, pattern starlark.String
+	var filesOnly, dirsOnly bool
+	err := starlark.UnpackArgs("Content.list", args, kwargs, "path", &path, "files_only?", &filesOnly, "dirs_only?", &dirsOnly, "pattern?", &pattern)
+	if err != nil {
+		return nil, err
+	}
+	if filesOnly && dirsOnly {
+		return nil, fmt.Errorf("Content.list: cannot use both files_only and dirs_only")
+	}
+	if pattern != "" {
+		err = checkPattern(pattern.GoString())
+		if err != nil {
+			return nil, fmt.Errorf("Content.list: invalid pattern: %s", pattern.GoString())
+		}
+	}
+
+	keep := func(entry fs.DirEntry) bool {
+		if filesOnly && !entry.Type().IsRegular() || dirsOnly && !entry.IsDir() {
+			return false
+		}
+		if pattern != "" {
+			// The pattern was checked above.
+			matched, _ := filepath.Match(pattern.GoString(), entry.Name())
+			return matched
+		}
+		return true
+	}
+	names, err := c.listNames(path, keep)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]Value, len(names))
+	for i, name := range names {
+		values[i] = starlark.String(name)
+	}
+	return starlark.NewList(values), nil
+}
+
+// ListPage is like List, but returns at most limit names at a time, so
+// that huge directories may be processed in bounded memory. It returns
+// the names together with a cursor to pass in the next call to get the
+// following page, or None once all names were returned. Names are in
+// lexical order, and the cursor is the last name returned, so entries
+// added or removed between calls do not shift the pages.
+func (c *ContentValue) ListPage(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
 	var path starlark.String
-	err := starlark.UnpackArgs("Content.list", args, kwargs, "path", &path)
+	var cursor Value = starlark.None
+	var limit = 1000
+	err := starlark.UnpackArgs("Content.list_page", args, kwargs, "path", &path, "cursor?", &cursor, "limit?", &limit)
 	if err != nil {
 		return nil, err
 	}
+	var after string
+	if cursor != starlark.None {
+		s, ok := cursor.(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("Content.list_page: for parameter cursor: got %s, want string or None", cursor.Type())
+		}
+		after = s.GoString()
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("Content.list_page: limit must be positive")
+	}
 
 	dpath := path.GoString()
 	if !strings.HasSuffix(dpath, "/") {
@@ -193,17 +1800,2330 @@ func (c *ContentValue) List(thread *starlark.Thread, fn *starlark.Builtin, args
 	if err != nil {
 		return nil, err
 	}
-	entries, err := os.ReadDir(fpath)
+	file, done, err := c.openFile(fpath, "readdir")
 	if err != nil {
 		return nil, c.polishError(path, err)
 	}
-	values := make([]Value, len(entries))
-	for i, entry := range entries {
+	defer file.Close()
+
+	// Only the first limit names after the cursor are kept, sorted, and
+	// any other name past the cursor means there are more pages.
+	names := make([]string, 0, limit)
+	more := false
+	for {
+		var entries []fs.DirEntry
+		entries, err = file.ReadDir(c.listChunkSize())
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			if after != "" && name <= after {
+				continue
+			}
+			i := sort.SearchStrings(names, name)
+			if len(names) == limit {
+				more = true
+				if i == limit {
+					continue
+				}
+				names = names[:limit-1]
+			}
+			names = append(names, "")
+			copy(names[i+1:], names[i:])
+			names[i] = name
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+
+	values := make([]Value, len(names))
+	for i, name := range names {
+		values[i] = starlark.String(name)
+	}
+	var next Value = starlark.None
+	if more {
+		next = starlark.String(names[len(names)-1])
+	}
+	return starlark.Tuple{starlark.NewList(values), next}, nil
+}
+
+// ByExtension is like List, but returns only the entries with names having
+// the extension ext, which may be given with or without the leading dot.
+// The comparison is case-insensitive if ignore_case is true.
+func (c *ContentValue) ByExtension(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var ext string
+	var ignoreCase bool
+	err := starlark.UnpackArgs("Content.by_extension", args, kwargs, "path", &path, "ext", &ext, "ignore_case?", &ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	if ext == "" || ext == "." {
+		return nil, fmt.Errorf("Content.by_extension: empty extension")
+	}
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	keep := func(entry fs.DirEntry) bool {
 		name := entry.Name()
-		if entry.IsDir() {
-			name += "/"
+		if len(name) <= len(ext) {
+			return false
+		}
+		suffix := name[len(name)-len(ext):]
+		if ignoreCase {
+			return strings.EqualFold(suffix, ext)
 		}
+		return suffix == ext
+	}
+	names, err := c.listNames(path, keep)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]Value, len(names))
+	for i, name := range names {
 		values[i] = starlark.String(name)
 	}
 	return starlark.NewList(values), nil
 }
+
+// checkPattern returns filepath.ErrBadPattern if pattern is malformed.
+// filepath.Match may give up on a name after a * wildcard without looking
+// at the rest of the pattern, so the pattern is checked without them.
+func checkPattern(pattern string) error {
+	var literal strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch {
+		case ch == '\\' && i+1 < len(pattern):
+			literal.WriteByte(ch)
+			i++
+			ch = pattern[i]
+		case ch == '[':
+			inClass = true
+		case ch == ']':
+			inClass = false
+		case ch == '*' && !inClass:
+			continue
+		}
+		literal.WriteByte(ch)
+	}
+	_, err := filepath.Match(literal.String(), "")
+	return err
+}
+
+// listNames returns the names of the entries in the directory at path in
+// lexical order, with a trailing slash for directories. If keep is not
+// nil, only the entries it returns true for are included.
+func (c *ContentValue) listNames(path starlark.String, keep func(entry fs.DirEntry) bool) ([]string, error) {
+	dpath := path.GoString()
+	if !strings.HasSuffix(dpath, "/") {
+		dpath += "/"
+	}
+	fpath, err := c.RealPath(dpath, CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.readDir(path, fpath)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if keep != nil && !keep(entry) {
+			continue
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	// Sort the final names so the trailing slash of directories is
+	// taken into account, keeping the result in lexical order.
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *ContentValue) DiskUsage(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var followSymlinks bool
+	err := starlark.UnpackArgs("Content.du", args, kwargs, "path", &path, "follow_symlinks?", &followSymlinks)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	if !info.IsDir() {
+		size, err := c.entryUsage(path.GoString(), info, followSymlinks)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.MakeInt64(size), nil
+	}
+
+	// Symlinks are only followed when they point to files, so that
+	// directories cannot be accounted for more than once.
+	var total int64
+	err = c.walkDir(path.GoString(), func(path string, entry fs.DirEntry) error {
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return c.polishError(starlark.String(path), err)
+		}
+		size, err := c.entryUsage(path, info, followSymlinks)
+		total += size
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt64(total), nil
+}
+
+func (c *ContentValue) entryUsage(path string, info fs.FileInfo, followSymlinks bool) (int64, error) {
+	if info.Mode()&fs.ModeSymlink != 0 && followSymlinks {
+		fpath, err := c.RealPath(path, CheckRead)
+		if err != nil {
+			return 0, err
+		}
+		info, err = os.Stat(fpath)
+		if err != nil {
+			return 0, c.polishError(starlark.String(path), err)
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return 0, nil
+	}
+	return info.Size(), nil
+}
+
+// Find returns the paths of the entries under the given directory for
+// which predicate returns true. If maxdepth is not negative, at most that
+// many levels of subdirectories are traversed, so zero only considers the
+// entries in the given directory.
+func (c *ContentValue) Find(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var predicate starlark.Callable
+	var maxDepth = -1
+	err := starlark.UnpackArgs("Content.find", args, kwargs, "path", &path, "predicate", &predicate, "maxdepth?", &maxDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []Value
+	base := strings.Count(dirPath(path.GoString()), "/")
+	err = c.walkDir(path.GoString(), func(path string, entry fs.DirEntry) error {
+		result, err := starlark.Call(thread, predicate, starlark.Tuple{starlark.String(path)}, nil)
+		if err != nil {
+			return err
+		}
+		if result.Truth() {
+			values = append(values, starlark.String(path))
+		}
+		if entry.IsDir() && maxDepth >= 0 && strings.Count(path, "/")-base > maxDepth {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return starlark.NewList(values), nil
+}
+
+// GlobCount returns the number of entries with content paths matching
+// pattern, using the wildcards documented in strdist.GlobPath. Directory
+// paths end with a slash, so "/foo/*/" matches only directories. The
+// matching entries are counted as they are found, without accumulating.
+func (c *ContentValue) GlobCount(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var pattern starlark.String
+	err := starlark.UnpackArgs("Content.glob_count", args, kwargs, "pattern", &pattern)
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	err = c.glob(pattern.GoString(), func(path string, entry fs.DirEntry) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt(count), nil
+}
+
+// GlobStat is like GlobCount, but returns a struct per matching entry with
+// its path, size, and whether it is a directory. The information is taken
+// while walking the tree, and symlinks are not followed.
+func (c *ContentValue) GlobStat(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var pattern starlark.String
+	err := starlark.UnpackArgs("Content.glob_stat", args, kwargs, "pattern", &pattern)
+	if err != nil {
+		return nil, err
+	}
+	var values []Value
+	err = c.glob(pattern.GoString(), func(path string, entry fs.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return c.polishError(starlark.String(path), err)
+		}
+		values = append(values, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"path":   starlark.String(path),
+			"is_dir": starlark.Bool(entry.IsDir()),
+			"size":   starlark.MakeInt64(info.Size()),
+		}))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return starlark.NewList(values), nil
+}
+
+// glob calls match with every entry with a content path matching the
+// pattern, as documented in GlobCount, in the order they are walked.
+func (c *ContentValue) glob(pattern string, match func(path string, entry fs.DirEntry) error) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("content path must be absolute, got: %s", pattern)
+	}
+
+	// Only walk under the deepest directory without wildcards, and no
+	// deeper than the pattern itself unless it has a ** wildcard.
+	start := pattern[:strings.LastIndex(pattern[:strings.IndexAny(pattern+"*", "*?")], "/")+1]
+	limited := !strings.Contains(pattern, "**")
+	depth := strings.Count(strings.TrimSuffix(pattern, "/"), "/") - strings.Count(start, "/") + 1
+	fpath, err := c.RealPath(start, CheckRead)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fpath)
+	if os.IsNotExist(err) || err == nil && !info.IsDir() {
+		return nil
+	}
+	if err != nil {
+		return c.polishError(starlark.String(start), err)
+	}
+
+	if start != "/" && strdist.GlobPath(pattern, start) {
+		err = match(start, fs.FileInfoToDirEntry(info))
+		if err != nil {
+			return err
+		}
+	}
+	return c.walkDir(start, func(path string, entry fs.DirEntry) error {
+		if strdist.GlobPath(pattern, path) {
+			err := match(path, entry)
+			if err != nil {
+				return err
+			}
+		}
+		if entry.IsDir() && limited && strings.Count(path, "/")-strings.Count(start, "/") >= depth {
+			return fs.SkipDir
+		}
+		return nil
+	})
+}
+
+// Sub returns a content value rooted at the content directory path.
+// The checks and the write callback of c are preserved, with paths
+// rebased so they observe the same locations they would if accessed
+// via c itself. All other settings are copied as they are, including
+// AllowImport, which is given host paths.
+func (c *ContentValue) Sub(path string) (*ContentValue, error) {
+	fpath, err := c.RealPath(path, CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		return nil, c.polishError(starlark.String(path), err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("content path is not a directory: %s", path)
+	}
+	prefix := filepath.Clean(path)
+	if prefix == "/" {
+		return c, nil
+	}
+	sub := &ContentValue{
+		RootDir:         fpath,
+		DryRun:          c.DryRun,
+		Umask:           c.Umask,
+		OpTimeout:       c.OpTimeout,
+		ExposeRoot:      c.ExposeRoot,
+		SymlinkMode:     c.SymlinkMode,
+		VerboseErrors:   c.VerboseErrors,
+		MaxWriteSize:    c.MaxWriteSize,
+		AllowChown:      c.AllowChown,
+		RecordOwnership: c.RecordOwnership,
+		ListChunkSize:   c.ListChunkSize,
+		ReadOnly:        c.ReadOnly,
+		AllowImport:     c.AllowImport,
+		parent:          c,
+	}
+	if c.CheckRead != nil {
+		sub.CheckRead = func(path string) error {
+			return c.CheckRead(prefix + path)
+		}
+	}
+	if c.CheckWrite != nil {
+		sub.CheckWrite = func(path string) error {
+			return c.CheckWrite(prefix + path)
+		}
+	}
+	if c.Transform != nil {
+		sub.Transform = func(path string, data []byte) ([]byte, error) {
+			return c.Transform(prefix+path, data)
+		}
+	}
+	if c.frozen.Load() {
+		sub.Freeze()
+	}
+	if c.Audit != nil {
+		sub.Audit = func(op string, path string, err error) {
+			c.audit(op, prefix+path, err)
+		}
+	}
+	if c.OnWrite != nil {
+		sub.OnWrite = func(entry *fsutil.Entry) error {
+			rebased := *entry
+			rebased.Path = prefix + entry.Path
+			return c.reportWrite(&rebased)
+		}
+	}
+	if c.OnRemove != nil {
+		sub.OnRemove = func(path string) error {
+			return c.reportRemove(prefix + path)
+		}
+	}
+	if c.OnConflict != nil {
+		sub.OnConflict = func(path string, existing, incoming *fsutil.Entry) (Decision, error) {
+			rebasedExisting := *existing
+			rebasedExisting.Path = prefix + existing.Path
+			rebasedIncoming := *incoming
+			rebasedIncoming.Path = prefix + incoming.Path
+			return c.reportConflict(&rebasedExisting, &rebasedIncoming)
+		}
+	}
+	return sub, nil
+}
+
+func (c *ContentValue) sub(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.sub", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+	return c.Sub(path.GoString())
+}
+
+// WriteJSON writes value encoded as JSON into the file at the given path.
+// Dictionary keys are sorted so the output is deterministic, and a positive
+// indent pretty-prints the output with that many spaces per level.
+func (c *ContentValue) WriteJSON(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var value Value
+	var indent int
+	err := starlark.UnpackArgs("Content.write_json", args, kwargs, "path", &path, "value", &value, "indent?", &indent)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := starlark.Call(thread, json.Module.Members["encode"], starlark.Tuple{value}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode %s as JSON: %w", path.GoString(), err)
+	}
+	if indent > 0 {
+		kwargs := []starlark.Tuple{{starlark.String("indent"), starlark.String(strings.Repeat(" ", indent))}}
+		encoded, err = starlark.Call(thread, json.Module.Members["indent"], starlark.Tuple{encoded}, kwargs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data := encoded.(starlark.String).GoString() + "\n"
+
+	entry, err := c.writeFile(path, strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return NewEntryValue(entry), nil
+}
+
+// ReadJSON decodes the JSON document in the file at the given path into
+// the respective Starlark value. Files larger than max_size bytes are
+// rejected without being fully read when that is positive.
+func (c *ContentValue) ReadJSON(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var maxSize int64
+	err := starlark.UnpackArgs("Content.read_json", args, kwargs, "path", &path, "max_size?", &maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	file, done, err := c.openFile(fpath, "read")
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if maxSize > 0 {
+		r = io.LimitReader(file, maxSize+1)
+	}
+	data, err := io.ReadAll(r)
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	if maxSize > 0 && int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("cannot decode %s as JSON: file exceeds %d bytes", path.GoString(), maxSize)
+	}
+
+	value, err := starlark.Call(thread, json.Module.Members["decode"], starlark.Tuple{starlark.String(data)}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s as JSON: %w", path.GoString(), err)
+	}
+	return value, nil
+}
+
+// ReadAll returns a dictionary mapping the content paths of the regular
+// files under the directory at path to their data, which is a string if
+// it's valid UTF-8 and bytes otherwise. Symlinks are not followed. If
+// max_total_size is positive, reading stops with an error once the files
+// read add up to more than that many bytes.
+func (c *ContentValue) ReadAll(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var maxTotalSize int64
+	err := starlark.UnpackArgs("Content.readall", args, kwargs, "path", &path, "max_total_size?", &maxTotalSize)
+	if err != nil {
+		return nil, err
+	}
+
+	result := starlark.NewDict(0)
+	var total int64
+	err = c.walkDir(path.GoString(), func(path string, entry fs.DirEntry) error {
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		// Check the size before reading as well, so that files too
+		// large are never loaded.
+		info, err := entry.Info()
+		if err != nil {
+			return c.polishError(starlark.String(path), err)
+		}
+		if maxTotalSize > 0 && total+info.Size() > maxTotalSize {
+			return fmt.Errorf("Content.readall: total size exceeds %d bytes", maxTotalSize)
+		}
+		fpath, err := c.RealPath(path, CheckRead)
+		if err != nil {
+			return err
+		}
+		data, err := c.readFile(starlark.String(path), fpath)
+		if err != nil {
+			return err
+		}
+		total += int64(len(data))
+		if maxTotalSize > 0 && total > maxTotalSize {
+			return fmt.Errorf("Content.readall: total size exceeds %d bytes", maxTotalSize)
+		}
+		var value Value = starlark.String(data)
+		if !utf8.Valid(data) {
+			value = starlark.Bytes(data)
+		}
+		return result.SetKey(starlark.String(path), value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ChecksumTree returns a dictionary mapping the content path of every regular
+// file and symlink under path to its digest in hex, computed with the given
+// algorithm. Files are streamed through the hash, while symlinks are not
+// followed and their target is hashed instead, keeping the result stable.
+func (c *ContentValue) ChecksumTree(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var algo = "sha256"
+	err := starlark.UnpackArgs("Content.checksum_tree", args, kwargs, "path", &path, "algo?", &algo)
+	if err != nil {
+		return nil, err
+	}
+	newHash, ok := hashAlgos[algo]
+	if !ok {
+		return nil, fmt.Errorf("Content.checksum_tree: unsupported algorithm: %q", algo)
+	}
+
+	result := starlark.NewDict(0)
+	err = c.walkDir(path.GoString(), func(path string, entry fs.DirEntry) error {
+		h := newHash()
+		switch {
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := c.readLink(path)
+			if err != nil {
+				return err
+			}
+			h.Write([]byte(link))
+		case entry.Type().IsRegular():
+			fpath, err := c.RealPath(path, CheckRead)
+			if err != nil {
+				return err
+			}
+			file, done, err := c.openFile(fpath, "read")
+			if err != nil {
+				return c.polishError(starlark.String(path), err)
+			}
+			defer file.Close()
+			_, err = io.Copy(h, file)
+			if err = done(err); err != nil {
+				return c.polishError(starlark.String(path), err)
+			}
+		default:
+			return nil
+		}
+		return result.SetKey(starlark.String(path), starlark.String(hex.EncodeToString(h.Sum(nil))))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReadLines returns the lines in the file at the given path. The file is
+// read incrementally, and line endings are dropped unless keepends is set.
+func (c *ContentValue) ReadLines(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var keepends bool
+	err := starlark.UnpackArgs("Content.read_lines", args, kwargs, "path", &path, "keepends?", &keepends)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	file, done, err := c.openFile(fpath, "read")
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	defer file.Close()
+
+	var values []Value
+	reader := bufio.NewReader(file)
+	for {
+		var line string
+		line, err = reader.ReadString('\n')
+		if line != "" {
+			if !keepends {
+				line = strings.TrimSuffix(line, "\n")
+				line = strings.TrimSuffix(line, "\r")
+			}
+			values = append(values, starlark.String(line))
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.NewList(values), nil
+}
+
+// Grep returns a (lineno, line) tuple for every line in the file at path
+// that contains pattern, or that matches it when regex is true. Line
+// numbers start at 1, and lines exclude their line ending. The file is
+// read one line at a time.
+func (c *ContentValue) Grep(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path, pattern starlark.String
+	var isRegex bool
+	err := starlark.UnpackArgs("Content.grep", args, kwargs, "path", &path, "pattern", &pattern, "regex?", &isRegex)
+	if err != nil {
+		return nil, err
+	}
+	match := func(line string) bool {
+		return strings.Contains(line, pattern.GoString())
+	}
+	if isRegex {
+		re, err := regexp.Compile(pattern.GoString())
+		if err != nil {
+			return nil, fmt.Errorf("Content.grep: invalid pattern: %w", err)
+		}
+		match = re.MatchString
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	file, done, err := c.openFile(fpath, "read")
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	defer file.Close()
+
+	var values []Value
+	reader := bufio.NewReader(file)
+	for lineno := 1; ; lineno++ {
+		var line string
+		line, err = reader.ReadString('\n')
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+		if match(line) && (line != "" || err != io.EOF) {
+			values = append(values, starlark.Tuple{starlark.MakeInt(lineno), starlark.String(line)})
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.NewList(values), nil
+}
+
+// MakeTemp implements both Content.mktemp and Content.mkdtemp, creating
+// respectively an empty file or directory with a unique name under dir,
+// and returning its content path. Directory paths end with a slash.
+func (c *ContentValue) MakeTemp(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var dir = starlark.String("/")
+	var prefix = starlark.String("tmp")
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "dir?", &dir, "prefix?", &prefix)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(prefix.GoString(), "/") {
+		return nil, fmt.Errorf("%s: prefix cannot contain slashes: %s", fn.Name(), prefix.GoString())
+	}
+
+	isDir := fn.Name() == "Content.mkdtemp"
+	entry, err := c.makeTemp(dir.GoString(), prefix.GoString(), isDir)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(entry.Path), nil
+}
+
+// WithTempDir creates a temporary directory as done by Content.mkdtemp,
+// calls fn with its content path, and removes it with everything under
+// it once fn returns, even if it fails. The result of fn is returned.
+// In dry-run mode only the removal of the directory itself is reported,
+// as nothing is actually written under it.
+func (c *ContentValue) WithTempDir(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var callback starlark.Callable
+	var dir = starlark.String("/")
+	var prefix = starlark.String("tmp")
+	err := starlark.UnpackArgs("Content.with_tempdir", args, kwargs, "fn", &callback, "dir?", &dir, "prefix?", &prefix)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(prefix.GoString(), "/") {
+		return nil, fmt.Errorf("Content.with_tempdir: prefix cannot contain slashes: %s", prefix.GoString())
+	}
+
+	entry, err := c.makeTemp(dir.GoString(), prefix.GoString(), true)
+	if err != nil {
+		return nil, err
+	}
+	result, err := starlark.Call(thread, callback, starlark.Tuple{starlark.String(entry.Path)}, nil)
+	if rerr := c.removeTree(entry.Path); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// removeTree removes the directory at the content path dir and everything
+// under it, deepest entries first, reporting each one via OnRemove.
+func (c *ContentValue) removeTree(dir string) error {
+	dir = dirPath(dir)
+	fpath, err := c.RealPath(dir, CheckWrite)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	if !c.DryRun {
+		err = c.walkDir(dir, func(path string, entry fs.DirEntry) error {
+			paths = append(paths, path)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		path := paths[i]
+		err := c.check(path, CheckWrite)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(filepath.Join(fpath, strings.TrimPrefix(path, dir)))
+		if err != nil {
+			return c.polishError(starlark.String(path), err)
+		}
+		err = c.reportRemove(path)
+		if err != nil {
+			return err
+		}
+	}
+	if !c.DryRun {
+		err = os.Remove(fpath)
+		if err != nil {
+			return c.polishError(starlark.String(dir), err)
+		}
+	}
+	return c.reportRemove(dir)
+}
+
+func (c *ContentValue) makeTemp(dir, prefix string, isDir bool) (*fsutil.Entry, error) {
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("content path must be absolute, got: %s", dir)
+	}
+	for {
+		path := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		fpath, err := c.RealPath(path, CheckWrite)
+		if err != nil {
+			return nil, err
+		}
+		var entry *fsutil.Entry
+		if isDir {
+			entry = &fsutil.Entry{Path: path + "/", Mode: fs.ModeDir | 0700&^c.Umask}
+		} else {
+			sum := sha256.Sum256(nil)
+			entry = &fsutil.Entry{Path: path, Mode: 0600 &^ c.Umask, Hash: hex.EncodeToString(sum[:])}
+		}
+		if !c.DryRun {
+			if isDir {
+				err = os.Mkdir(fpath, entry.Mode.Perm())
+			} else {
+				var file *os.File
+				file, err = os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_EXCL, entry.Mode.Perm())
+				if err == nil {
+					err = file.Close()
+				}
+			}
+			if os.IsExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, c.writeError(starlark.String(path), err)
+			}
+		}
+		err = c.reportWrite(entry)
+		if err != nil {
+			return nil, err
+		}
+		return entry, nil
+	}
+}
+
+// Touch creates an empty file at the given path if it doesn't exist yet,
+// and sets its modification time to mtime, a Unix timestamp, or to the
+// current time if mtime is not provided.
+func (c *ContentValue) Touch(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var mtime Value = starlark.None
+	err := starlark.UnpackArgs("Content.touch", args, kwargs, "path", &path, "mtime?", &mtime)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Now()
+	if mtime != starlark.None {
+		var sec int64
+		err := starlark.AsInt(mtime, &sec)
+		if err != nil {
+			return nil, fmt.Errorf("Content.touch: for parameter mtime: %w", err)
+		}
+		t = time.Unix(sec, 0)
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Lstat(fpath)
+	if os.IsNotExist(err) {
+		_, err = c.writeFile(path, strings.NewReader(""))
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	if c.DryRun {
+		return starlark.None, nil
+	}
+	err = os.Chtimes(fpath, t, t)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.None, nil
+}
+
+// SetTimes sets the modification and access times of the entry at path to
+// the provided Unix timestamps. The access time defaults to the
+// modification time. With recursive set, the times of all entries under a
+// directory are set as well, except for symlinks, which are not followed.
+// Every changed entry is reported to OnWrite.
+func (c *ContentValue) SetTimes(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var mtime int64
+	var atime Value = starlark.None
+	var recursive bool
+	err := starlark.UnpackArgs("Content.set_times", args, kwargs, "path", &path, "mtime", &mtime, "atime?", &atime, "recursive?", &recursive)
+	if err != nil {
+		return nil, err
+	}
+	mt := time.Unix(mtime, 0)
+	at := mt
+	if atime != starlark.None {
+		var sec int64
+		err := starlark.AsInt(atime, &sec)
+		if err != nil {
+			return nil, fmt.Errorf("Content.set_times: for parameter atime: %w", err)
+		}
+		at = time.Unix(sec, 0)
+	}
+
+	err = c.setTimes(path.GoString(), at, mt)
+	if err != nil || !recursive {
+		return starlark.None, err
+	}
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	if !info.IsDir() {
+		return starlark.None, nil
+	}
+	err = c.walkDir(path.GoString(), func(path string, entry fs.DirEntry) error {
+		if entry.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		return c.setTimes(path, at, mt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+func (c *ContentValue) setTimes(path string, atime, mtime time.Time) error {
+	fpath, err := c.RealPath(path, CheckWrite)
+	if err != nil {
+		return err
+	}
+	if !c.DryRun {
+		err = os.Chtimes(fpath, atime, mtime)
+		if err != nil {
+			return c.polishError(starlark.String(path), err)
+		}
+	}
+	if c.OnWrite == nil {
+		return nil
+	}
+	entry, err := c.statEntry(path, fpath)
+	if err != nil {
+		return err
+	}
+	return c.reportWrite(entry)
+}
+
+// Chown changes the user and group owning the entry at path to the
+// given ids, and reports the entry with its new ownership to OnWrite.
+func (c *ContentValue) Chown(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var uid, gid int
+	err := starlark.UnpackArgs("Content.chown", args, kwargs, "path", &path, "uid", &uid, "gid", &gid)
+	if err != nil {
+		return nil, err
+	}
+	if uid < 0 || gid < 0 {
+		return nil, fmt.Errorf("Content.chown: ids must not be negative")
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	if !c.DryRun && !c.RecordOwnership {
+		err = os.Lchown(fpath, uid, gid)
+		if err != nil {
+			return nil, c.polishError(path, err)
+		}
+	}
+	// Symlinks are changed themselves, so they are reported as such.
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	var entry *fsutil.Entry
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err := os.Readlink(fpath)
+		if err != nil {
+			return nil, c.polishError(path, err)
+		}
+		entry = &fsutil.Entry{Path: filepath.Clean(path.GoString()), Mode: info.Mode(), Link: link}
+	} else {
+		entry, err = c.statEntry(path.GoString(), fpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	entry.Owner = &fsutil.Owner{UID: uid, GID: gid}
+	err = c.reportWrite(entry)
+	if err != nil {
+		return nil, err
+	}
+	return NewEntryValue(entry), nil
+}
+
+// statEntry returns the entry describing the existing file at fpath, which
+// is the real path for the content path.
+func (c *ContentValue) statEntry(path, fpath string) (*fsutil.Entry, error) {
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return nil, c.polishError(starlark.String(path), err)
+	}
+	entry := &fsutil.Entry{Path: filepath.Clean(path), Mode: info.Mode()}
+	if info.IsDir() {
+		entry.Path = dirPath(entry.Path)
+		return entry, nil
+	}
+	if !info.Mode().IsRegular() {
+		return entry, nil
+	}
+	file, done, err := c.openFile(fpath, "read")
+	if err != nil {
+		return nil, c.polishError(starlark.String(path), err)
+	}
+	defer file.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err = done(err); err != nil {
+		return nil, c.polishError(starlark.String(path), err)
+	}
+	entry.Hash = hex.EncodeToString(h.Sum(nil))
+	entry.Size = int(size)
+	return entry, nil
+}
+
+// Truncate changes the size of the existing regular file at path to size,
+// which defaults to zero. Growing the file is allowed up to MaxWriteSize,
+// and the extension reads as zeros. As the zeros are hashed to report the
+// entry, hashing them is bounded by OpTimeout as reading is, and the file
+// is only changed once that succeeded.
+func (c *ContentValue) Truncate(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var size int64
+	err := starlark.UnpackArgs("Content.truncate", args, kwargs, "path", &path, "size?", &size)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("Content.truncate: size must not be negative")
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok {
+			e.Op = "truncate"
+		}
+		return nil, c.polishError(path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("cannot truncate non-regular file: %s", path.GoString())
+	}
+	err = c.checkWriteSize(path, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// The hash is computed from the data the file will have after
+	// truncating it, before actually doing so.
+	var deadline time.Time
+	if c.OpTimeout > 0 {
+		deadline = time.Now().Add(c.OpTimeout)
+	}
+	file, done, err := c.openFile(fpath, "read")
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	defer file.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(file, size))
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	zeros := make([]byte, 32*1024)
+	for ; n < size; n += int64(len(zeros)) {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, c.polishError(path, &os.PathError{Op: "truncate", Path: fpath, Err: os.ErrDeadlineExceeded})
+		}
+		if size-n < int64(len(zeros)) {
+			zeros = zeros[:size-n]
+		}
+		h.Write(zeros)
+	}
+	if !c.DryRun {
+		err = os.Truncate(fpath, size)
+		if err != nil {
+			return nil, c.writeError(path, err)
+		}
+	}
+	entry := &fsutil.Entry{
+		Path: filepath.Clean(path.GoString()),
+		Mode: info.Mode(),
+		Hash: hex.EncodeToString(h.Sum(nil)),
+		Size: int(size),
+	}
+	err = c.reportWrite(entry)
+	if err != nil {
+		return nil, err
+	}
+	return NewEntryValue(entry), nil
+}
+
+// AppendLine appends line and a newline to the file at path, creating it
+// if missing. A newline is also inserted first if the file does not end
+// with one. With unique set, nothing is appended if the file already has
+// the line. It returns whether the file was changed, and reports its
+// final state via OnWrite when it was.
+func (c *ContentValue) AppendLine(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var line string
+	var unique bool
+	err := starlark.UnpackArgs("Content.append_line", args, kwargs, "path", &path, "line", &line, "unique?", &unique)
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if strings.Contains(line, "\n") {
+		return nil, fmt.Errorf("Content.append_line: line must not contain newlines")
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	mode := 0644 &^ c.Umask
+	var data []byte
+	info, err := os.Stat(fpath)
+	if err == nil {
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("cannot append to non-regular file: %s", path.GoString())
+		}
+		mode = info.Mode()
+		data, err = c.readFile(path, fpath)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, c.polishError(path, err)
+	}
+	if unique {
+		for _, l := range strings.Split(string(data), "\n") {
+			if l == line {
+				return starlark.False, nil
+			}
+		}
+	}
+	var add []byte
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		add = append(add, '\n')
+	}
+	add = append(add, line...)
+	add = append(add, '\n')
+	err = c.checkWriteSize(path, int64(len(data)+len(add)))
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.DryRun {
+		file, err := os.OpenFile(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+		if err != nil {
+			return nil, c.writeError(path, err)
+		}
+		_, err = file.Write(add)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, c.writeError(path, err)
+		}
+	}
+	h := sha256.New()
+	h.Write(data)
+	h.Write(add)
+	err = c.reportWrite(&fsutil.Entry{
+		Path: filepath.Clean(path.GoString()),
+		Mode: mode,
+		Hash: hex.EncodeToString(h.Sum(nil)),
+		Size: len(data) + len(add),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return starlark.True, nil
+}
+
+// ReadDir is similar to List, but returns a struct per entry with its
+// name, size, and whether it is a directory or a symlink.
+func (c *ContentValue) ReadDir(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.readdir", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	dpath := path.GoString()
+	if !strings.HasSuffix(dpath, "/") {
+		dpath += "/"
+	}
+	fpath, err := c.RealPath(dpath, CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.readDir(path, fpath)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]Value, len(entries))
+	for i, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, c.polishError(starlark.String(dpath+entry.Name()), err)
+		}
+		values[i] = starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"name":       starlark.String(entry.Name()),
+			"is_dir":     starlark.Bool(entry.IsDir()),
+			"is_symlink": starlark.Bool(entry.Type()&fs.ModeSymlink != 0),
+			"size":       starlark.MakeInt64(info.Size()),
+		})
+	}
+	return starlark.NewList(values), nil
+}
+
+// MoveInto copies the regular file at the absolute host path into the
+// content path, once approved by AllowImport. Symlinks in the host path
+// are resolved before asking for approval, so that they cannot be used to
+// import files from elsewhere. The host file itself is left untouched.
+func (c *ContentValue) MoveInto(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var hostPath starlark.String
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.move_into", args, kwargs, "host_path", &hostPath, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+	if c.AllowImport == nil {
+		return nil, fmt.Errorf("Content.move_into: imports are not allowed")
+	}
+
+	hpath := hostPath.GoString()
+	if !filepath.IsAbs(hpath) {
+		return nil, fmt.Errorf("host path must be absolute, got: %s", hpath)
+	}
+	hpath, err = filepath.EvalSymlinks(filepath.Clean(hpath))
+	if err != nil {
+		return nil, err
+	}
+	err = c.AllowImport(hpath)
+	if err != nil {
+		return nil, err
+	}
+	// Refuse a symlink swapped in after resolving, and don't wait for
+	// writers if it's a named pipe, as that is refused below anyway.
+	// The follow policy of openFile is for content paths, so the file
+	// is watched here directly to get the same OpTimeout handling.
+	file, err := os.OpenFile(hpath, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	done := c.watchFile(file, hpath, "read")
+	info, err := file.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("cannot import non-regular file: %s", hpath)
+	}
+	if err == nil {
+		err = c.checkWriteSize(path, info.Size())
+	}
+	var entry *fsutil.Entry
+	if err == nil {
+		entry, err = c.writeFile(path, file)
+	}
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return NewEntryValue(entry), nil
+}
+
+// osRename is replaced in tests to simulate failed renames, such as
+// moves across devices.
+var osRename = os.Rename
+
+// Move moves the file or symlink at src to dst, replacing any such entry
+// already at dst, and reports the entry at its new path via OnWrite and
+// the removal of src via OnRemove. When the two are on different devices,
+// as may happen when RootDir spans a bind mount, the data is copied with
+// the same mode and src is removed afterwards.
+func (c *ContentValue) Move(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var src, dst starlark.String
+	err := starlark.UnpackArgs("Content.move", args, kwargs, "src", &src, "dst", &dst)
+	if err != nil {
+		return nil, err
+	}
+
+	spath, err := c.RealPath(src.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(spath)
+	if err != nil {
+		return nil, c.polishError(src, err)
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("cannot move directory: %s", src.GoString())
+	}
+	dpath, err := c.RealPath(dst.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	var entry *fsutil.Entry
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err := os.Readlink(spath)
+		if err != nil {
+			return nil, c.polishError(src, err)
+		}
+		entry = &fsutil.Entry{Mode: info.Mode(), Link: link}
+	} else {
+		entry, err = c.statEntry(src.GoString(), spath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !c.DryRun {
+		err = osRename(spath, dpath)
+		if errors.Is(err, syscall.EXDEV) {
+			err = c.moveAcross(src, spath, dpath, entry)
+		}
+		if err != nil {
+			if e, ok := err.(*os.LinkError); ok {
+				err = &os.PathError{Op: e.Op, Path: dst.GoString(), Err: e.Err}
+			}
+			return nil, c.writeError(dst, err)
+		}
+	}
+	entry.Path = filepath.Clean(dst.GoString())
+	err = c.reportWrite(entry)
+	if err != nil {
+		return nil, err
+	}
+	err = c.reportRemove(filepath.Clean(src.GoString()))
+	if err != nil {
+		return nil, err
+	}
+	return NewEntryValue(entry), nil
+}
+
+// moveAcross moves the entry at the real path spath to dpath by copying
+// it and then removing spath, for when the two are on different devices.
+// Reading is subject to OpTimeout, and a partial copy is removed.
+func (c *ContentValue) moveAcross(src starlark.String, spath, dpath string, entry *fsutil.Entry) error {
+	options := &fsutil.CreateOptions{Path: dpath, Mode: entry.Mode, Link: entry.Link}
+	if entry.Mode.IsRegular() {
+		file, done, err := c.openFile(spath, "read")
+		if err != nil {
+			return c.polishError(src, err)
+		}
+		defer file.Close()
+		options.Data = file
+		_, err = fsutil.Create(options)
+		if err == nil {
+			// The mode of a replaced file is kept when opening it.
+			err = os.Chmod(dpath, entry.Mode.Perm())
+		}
+		if err = done(err); err != nil {
+			os.Remove(dpath)
+			return err
+		}
+	} else {
+		_, err := fsutil.Create(options)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(spath)
+}
+
+// Hardlink creates a hard link at path to the regular file at target, and
+// returns the entry for it. An existing entry at path is only replaced
+// when force is true, and never if it is a directory. The replacement is
+// atomic, so the existing entry is kept if the link fails.
+func (c *ContentValue) Hardlink(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var target, path starlark.String
+	var force bool
+	err := starlark.UnpackArgs("Content.hardlink", args, kwargs, "target", &target, "path", &path, "force?", &force)
+	if err != nil {
+		return nil, err
+	}
+
+	tpath, err := c.RealPath(target.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(tpath)
+	if err != nil {
+		return nil, c.polishError(target, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("cannot hardlink to non-regular file: %s", target.GoString())
+	}
+	fpath, err := c.RealPath(path.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	info, err = os.Lstat(fpath)
+	replace := err == nil
+	if replace {
+		if !force || info.IsDir() {
+			return nil, &os.PathError{Op: "link", Path: path.GoString(), Err: syscall.EEXIST}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, c.polishError(path, err)
+	}
+	if !c.DryRun {
+		if replace {
+			// Link next to the existing entry and rename over it, so
+			// that it's only lost once the new link is in place.
+			err = c.linkOver(tpath, fpath)
+		} else {
+			err = os.Link(tpath, fpath)
+		}
+		if err != nil {
+			if e, ok := err.(*os.LinkError); ok {
+				err = &os.PathError{Op: e.Op, Path: fpath, Err: e.Err}
+			}
+			return nil, c.writeError(path, err)
+		}
+	}
+	entry, err := c.statEntry(target.GoString(), tpath)
+	if err != nil {
+		return nil, err
+	}
+	entry.Path = filepath.Clean(path.GoString())
+	err = c.reportWrite(entry)
+	if err != nil {
+		return nil, err
+	}
+	return NewEntryValue(entry), nil
+}
+
+// linkOver creates a hard link to tpath under a temporary name in the
+// directory of fpath, and then renames it over fpath.
+func (c *ContentValue) linkOver(tpath, fpath string) error {
+	for {
+		tmp := filepath.Join(filepath.Dir(fpath), "."+filepath.Base(fpath)+"."+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		err := os.Link(tpath, tmp)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = osRename(tmp, fpath)
+		if err != nil {
+			os.Remove(tmp)
+		}
+		return err
+	}
+}
+
+// CopyTree copies the directory at src and everything under it to dst,
+// preserving modes except for the bits in Umask, and reports every entry
+// created via OnWrite. Entries with content paths matching any of the
+// exclude patterns, using the wildcards documented in strdist.GlobPath,
+// are skipped without being read, as is everything under excluded
+// directories. Symlinks are copied as they are.
+func (c *ContentValue) CopyTree(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var src, dst starlark.String
+	var exclude *starlark.List
+	err := starlark.UnpackArgs("Content.copy_tree", args, kwargs, "src", &src, "dst", &dst, "exclude?", &exclude)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	if exclude != nil {
+		for i := 0; i < exclude.Len(); i++ {
+			pattern, ok := starlark.AsString(exclude.Index(i))
+			if !ok {
+				return nil, fmt.Errorf("Content.copy_tree: exclude must be a list of strings, got %s in list", exclude.Index(i).Type())
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	fpath, err := c.RealPath(src.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return nil, c.polishError(src, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("content path is not a directory: %s", src.GoString())
+	}
+	if !filepath.IsAbs(dst.GoString()) {
+		return nil, fmt.Errorf("content path must be absolute, got: %s", dst.GoString())
+	}
+	sdir := dirPath(src.GoString())
+	ddir := dirPath(dst.GoString())
+	if strings.HasPrefix(ddir, sdir) {
+		return nil, fmt.Errorf("cannot copy %s into itself", src.GoString())
+	}
+
+	err = c.createDir(strings.TrimSuffix(ddir, "/"), info.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+	err = c.walkDir(sdir, func(path string, entry fs.DirEntry) error {
+		for _, pattern := range patterns {
+			if strdist.GlobPath(pattern, path) {
+				return fs.SkipDir
+			}
+		}
+		return c.copyEntry(path, ddir+strings.TrimPrefix(path, sdir), entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+// copyEntry copies the entry found at the content path src to dst.
+func (c *ContentValue) copyEntry(src, dst string, entry fs.DirEntry) error {
+	info, err := entry.Info()
+	if err != nil {
+		return c.polishError(starlark.String(src), err)
+	}
+	switch {
+	case info.IsDir():
+		return c.createDir(strings.TrimSuffix(dst, "/"), info.Mode().Perm())
+	case info.Mode()&fs.ModeSymlink != 0:
+		return c.copySymlink(src, dst)
+	case !info.Mode().IsRegular():
+		return fmt.Errorf("cannot copy non-regular file: %s", src)
+	}
+	err = c.checkWriteSize(starlark.String(dst), info.Size())
+	if err != nil {
+		return err
+	}
+	fpath, err := c.RealPath(src, CheckRead)
+	if err != nil {
+		return err
+	}
+	file, done, err := c.openFile(fpath, "read")
+	if err != nil {
+		return c.polishError(starlark.String(src), err)
+	}
+	defer file.Close()
+	_, err = c.createFile(starlark.String(dst), file, info.Mode().Perm(), false)
+	return done(err)
+}
+
+// copySymlink creates a symlink at the content path dst with the same
+// target as the one at src. Neither of them is followed.
+func (c *ContentValue) copySymlink(src, dst string) error {
+	link, err := c.readLink(src)
+	if err != nil {
+		return err
+	}
+	err = c.check(dst, CheckWrite)
+	if err != nil {
+		return err
+	}
+	ddir, err := c.RealPath(dirPath(filepath.Dir(dst)), CheckNone)
+	if err != nil {
+		return err
+	}
+	entry := &fsutil.Entry{Mode: fs.ModeSymlink | 0777, Link: link}
+	if !c.DryRun {
+		entry, err = fsutil.Create(&fsutil.CreateOptions{
+			Path: filepath.Join(ddir, filepath.Base(dst)),
+			Mode: entry.Mode,
+			Link: link,
+		})
+		if err != nil {
+			return c.writeError(starlark.String(dst), err)
+		}
+	}
+	entry.Path = dst
+	return c.reportWrite(entry)
+}
+
+// readLink returns the target of the symlink at the content path, which is
+// checked for reading but not followed.
+func (c *ContentValue) readLink(path string) (string, error) {
+	// RealPath follows the symlinks themselves, so only the parent
+	// directories are resolved.
+	err := c.check(path, CheckRead)
+	if err != nil {
+		return "", err
+	}
+	dir, err := c.RealPath(dirPath(filepath.Dir(path)), CheckNone)
+	if err != nil {
+		return "", err
+	}
+	link, err := os.Readlink(filepath.Join(dir, filepath.Base(path)))
+	if err != nil {
+		return "", c.polishError(starlark.String(path), err)
+	}
+	return link, nil
+}
+
+// Count returns the number of entries in the directory at the given path.
+// Entries are read in chunks and never accumulated, so it's cheaper than
+// taking the length of the list result.
+func (c *ContentValue) Count(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.count", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	dpath := path.GoString()
+	if !strings.HasSuffix(dpath, "/") {
+		dpath += "/"
+	}
+	fpath, err := c.RealPath(dpath, CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	file, done, err := c.openFile(fpath, "readdir")
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	defer file.Close()
+	count := 0
+	for err == nil {
+		var names []string
+		names, err = file.Readdirnames(64)
+		count += len(names)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.MakeInt(count), nil
+}
+
+// Replace substitutes new for the first count occurrences of old in the
+// file at the given path, or for all of them if count is negative, and
+// returns the number of replacements made. The file is left untouched if
+// old is not found, which is an error if required is set. Otherwise the
+// new data is written to a temporary file with the same mode, regardless
+// of Umask, that replaces the original one only once complete, so the file
+// is never left partially rewritten.
+func (c *ContentValue) Replace(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path, old, new starlark.String
+	var count = -1
+	var required bool
+	err := starlark.UnpackArgs("Content.replace", args, kwargs, "path", &path, "old", &old, "new", &new, "count?", &count, "required?", &required)
+	if err != nil {
+		return nil, err
+	}
+	if old == "" {
+		return nil, fmt.Errorf("Content.replace: empty old string")
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead|CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.readFile(path, fpath)
+	if err != nil {
+		return nil, err
+	}
+	before := string(data)
+	n := strings.Count(before, old.GoString())
+	if count >= 0 && n > count {
+		n = count
+	}
+	if n == 0 {
+		if required {
+			return nil, fmt.Errorf("Content.replace: %q not found in %s", old.GoString(), path.GoString())
+		}
+		return starlark.MakeInt(0), nil
+	}
+	after := strings.Replace(before, old.GoString(), new.GoString(), n)
+	if c.Transform != nil {
+		data, err := c.Transform(filepath.Clean(path.GoString()), []byte(after))
+		if err != nil {
+			return nil, fmt.Errorf("cannot transform %s: %w", path.GoString(), err)
+		}
+		after = string(data)
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	// The file keeps its mode exactly, as it's only edited.
+	mode := info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	w, err := c.openWriter(path, mode, true)
+	if err != nil {
+		return nil, err
+	}
+	err = w.write(after)
+	if err != nil {
+		w.discard()
+		return nil, err
+	}
+	_, err = w.close()
+	if err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt(n), nil
+}
+
+// Lstat returns information about the entry at the given path. Symlinks
+// are not followed, and their target is reported instead. The target must
+// still be within the content, but it doesn't need to exist.
+func (c *ContentValue) Lstat(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.lstat", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	var target string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err = os.Readlink(fpath)
+		if err != nil {
+			return nil, c.polishError(path, err)
+		}
+	}
+	return statValue(filepath.Clean(path.GoString()), info, target), nil
+}
+
+// IsType implements both Content.is_dir and Content.is_file, reporting
+// whether path is respectively a directory or a regular file. Symlinks
+// are followed unless follow_symlinks is false, and missing paths are
+// neither.
+func (c *ContentValue) IsType(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var followSymlinks = true
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &path, "follow_symlinks?", &followSymlinks)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	stat := os.Lstat
+	if followSymlinks {
+		stat = os.Stat
+	}
+	info, err := stat(fpath)
+	if os.IsNotExist(err) {
+		return starlark.False, nil
+	}
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	if fn.Name() == "Content.is_dir" {
+		return starlark.Bool(info.IsDir()), nil
+	}
+	return starlark.Bool(info.Mode().IsRegular()), nil
+}
+
+// IsEmpty reports whether the file at path has no data, or the directory
+// at path has no entries. Only a single directory entry is read.
+func (c *ContentValue) IsEmpty(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.is_empty", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	if !info.IsDir() {
+		return starlark.Bool(info.Size() == 0), nil
+	}
+	file, done, err := c.openFile(fpath, "readdir")
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	defer file.Close()
+	_, err = file.ReadDir(1)
+	empty := err == io.EOF
+	if empty {
+		err = nil
+	}
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	return starlark.Bool(empty), nil
+}
+
+func (c *ContentValue) close(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	err := starlark.UnpackArgs("Content.close", args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, c.Close()
+}
+
+// Help returns the signatures of the methods available in the content,
+// one per line and sorted by name.
+func (c *ContentValue) Help(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	err := starlark.UnpackArgs("Content.help", args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	var buf strings.Builder
+	for _, name := range contentMethodNames {
+		if !c.hasMethod(name) {
+			continue
+		}
+		params, ok := contentMethodParams[name]
+		if !ok {
+			params = "..."
+		}
+		fmt.Fprintf(&buf, "%s(%s)\n", name, params)
+	}
+	return starlark.String(buf.String()), nil
+}
+
+// maxSymlinks bounds the number of symlinks followed when resolving a
+// single path, as done by the kernel, so that loops are detected.
+const maxSymlinks = 40
+
+// Resolve resolves the symlinks in every component of path, returning a
+// struct with the final path and a list of (path, target) tuples for
+// each symlink followed, in order. Absolute targets are interpreted as
+// relative to the content root, and targets leading outside of it are
+// rejected. Components that do not exist are kept as they are, and the
+// final path ends with a slash if it is a directory.
+func (c *ContentValue) Resolve(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.resolve", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	var links []Value
+	resolved := "/"
+	pending := strings.Split(strings.Trim(filepath.Clean(path.GoString()), "/"), "/")
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			// The path itself was validated, so only a symlink target
+			// may lead outside of the root.
+			if resolved == "/" {
+				last := links[len(links)-1].(starlark.Tuple)
+				return nil, fmt.Errorf("invalid content symlink: %s", last[0].(starlark.String).GoString())
+			}
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		fpath, err := c.RealPath(next, CheckRead)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Lstat(fpath)
+		if os.IsNotExist(err) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return nil, c.polishError(starlark.String(next), err)
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if len(links) == maxSymlinks {
+			return nil, &os.PathError{Op: "resolve", Path: path.GoString(), Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(fpath)
+		if err != nil {
+			return nil, c.polishError(starlark.String(next), err)
+		}
+		links = append(links, starlark.Tuple{starlark.String(next), starlark.String(target)})
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(strings.Trim(target, "/"), "/"), pending...)
+	}
+	if resolved != "/" {
+		info, err := os.Lstat(filepath.Join(c.RootDir, resolved))
+		if err == nil && info.IsDir() {
+			resolved += "/"
+		}
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"path":     starlark.String(resolved),
+		"symlinks": starlark.NewList(links),
+	}), nil
+}
+
+func statValue(path string, info fs.FileInfo, target string) Value {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"path":        starlark.String(path),
+		"size":        starlark.MakeInt64(info.Size()),
+		"mode":        starlark.MakeUint(uint(info.Mode().Perm())),
+		"mtime":       starlark.MakeInt64(info.ModTime().Unix()),
+		"is_dir":      starlark.Bool(info.IsDir()),
+		"is_file":     starlark.Bool(info.Mode().IsRegular()),
+		"is_symlink":  starlark.Bool(info.Mode()&fs.ModeSymlink != 0),
+		"link_target": starlark.String(target),
+	})
+}
+
+// Mkdir creates a directory at the given path. If make_parents is set,
+// missing parent directories are created as well, and it's not an error
+// for the directory to exist already.
+func (c *ContentValue) Mkdir(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var makeParents bool
+	err := starlark.UnpackArgs("Content.mkdir", args, kwargs, "path", &path, "make_parents?", &makeParents)
+	if err != nil {
+		return nil, err
+	}
+
+	if makeParents {
+		err = c.makeDirs(path.GoString())
+	} else {
+		err = c.makeDir(path.GoString())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+// EnsureDir makes sure the directory at path exists, creating it and any
+// missing parents as needed. Unlike mkdir, it succeeds if the directory
+// is already present, and fails only if something else is at the path.
+func (c *ContentValue) EnsureDir(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	err := starlark.UnpackArgs("Content.ensure_dir", args, kwargs, "path", &path)
+	if err != nil {
+		return nil, err
+	}
+	err = c.makeDirs(path.GoString())
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+// makeDirs creates the directory at the content path dir and any missing
+// parents, outermost first. Every directory created is checked for writing
+// and reported via OnWrite, while existing ones are left alone.
+func (c *ContentValue) makeDirs(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("content path must be absolute, got: %s", dir)
+	}
+	dir = filepath.Clean(dir)
+	var levels []string
+	for d := dir; d != "/"; d = filepath.Dir(d) {
+		levels = append(levels, d)
+	}
+	for i := len(levels) - 1; i >= 0; i-- {
+		fpath, err := c.RealPath(levels[i], CheckNone)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(fpath)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("content path is not a directory: %s", levels[i])
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return c.polishError(starlark.String(levels[i]), err)
+		}
+		err = c.createDir(levels[i], 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeDir creates the directory at the content path dir, which must not
+// exist yet, and reports it via OnWrite.
+func (c *ContentValue) makeDir(dir string) error {
+	fpath, err := c.RealPath(dir, CheckNone)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(fpath); err == nil {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.EEXIST}
+	}
+	return c.createDir(filepath.Clean(dir), 0755)
+}
+
+// createDir creates the directory at the clean content path dir with the
+// given permissions, subject to Umask, and reports it via OnWrite.
+func (c *ContentValue) createDir(dir string, perm fs.FileMode) error {
+	dpath := dir + "/"
+	fpath, err := c.RealPath(dpath, CheckWrite)
+	if err != nil {
+		return err
+	}
+	entry := &fsutil.Entry{Mode: fs.ModeDir | perm&^c.Umask}
+	if !c.DryRun {
+		entry, err = fsutil.Create(&fsutil.CreateOptions{
+			Path: fpath,
+			Mode: entry.Mode,
+		})
+		if err != nil {
+			return c.writeError(starlark.String(dir), err)
+		}
+	}
+	entry.Path = dpath
+	return c.reportWrite(entry)
+}
+
+// hashAlgos holds the hash algorithms supported by Content.verify and
+// Content.checksum_tree.
+var hashAlgos = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// Verify returns whether the digest of the file at path, computed with the
+// given algorithm while streaming its data, matches the expected one in
+// hex. A mismatch is an error unless required is false. The digests are
+// compared in constant time.
+func (c *ContentValue) Verify(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path, expected starlark.String
+	var algo = "sha256"
+	var required = true
+	err := starlark.UnpackArgs("Content.verify", args, kwargs, "path", &path, "expected", &expected, "algo?", &algo, "required?", &required)
+	if err != nil {
+		return nil, err
+	}
+	newHash, ok := hashAlgos[algo]
+	if !ok {
+		return nil, fmt.Errorf("Content.verify: unsupported algorithm: %q", algo)
+	}
+	h := newHash()
+	want, err := hex.DecodeString(expected.GoString())
+	if err != nil || len(want) != h.Size() {
+		return nil, fmt.Errorf("Content.verify: invalid %s digest: %q", algo, expected.GoString())
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	file, done, err := c.openFile(fpath, "read")
+	if err != nil {
+		return nil, c.polishError(path, err)
+	}
+	defer file.Close()
+	_, err = io.Copy(h, file)
+	if err = done(err); err != nil {
+		return nil, c.polishError(path, err)
+	}
+	got := h.Sum(nil)
+	if subtle.ConstantTimeCompare(got, want) == 1 {
+		return starlark.True, nil
+	}
+	if required {
+		return nil, fmt.Errorf("digest mismatch for %s: expected %x got %x", path.GoString(), want, got)
+	}
+	return starlark.False, nil
+}
+
+// NewerThan returns whether the modification time of the entry at path_a
+// is strictly later than that of the entry at path_b, following symlinks.
+// A missing path_a is never newer, so that outputs not yet generated are
+// considered stale, but a missing path_b is an error.
+func (c *ContentValue) NewerThan(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var pathA, pathB starlark.String
+	err := starlark.UnpackArgs("Content.newer_than", args, kwargs, "path_a", &pathA, "path_b", &pathB)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos [2]fs.FileInfo
+	for i, path := range []starlark.String{pathA, pathB} {
+		fpath, err := c.RealPath(path.GoString(), CheckRead)
+		if err != nil {
+			return nil, err
+		}
+		infos[i], err = os.Stat(fpath)
+		if err != nil && !(i == 0 && os.IsNotExist(err)) {
+			return nil, c.polishError(path, err)
+		}
+	}
+	if infos[0] == nil {
+		return starlark.False, nil
+	}
+	return starlark.Bool(infos[0].ModTime().After(infos[1].ModTime())), nil
+}
+
+// Compare returns whether the files at the two paths have the same data.
+// Files are streamed in chunks, and the comparison stops at the first
+// difference found.
+func (c *ContentValue) Compare(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var pathA, pathB starlark.String
+	err := starlark.UnpackArgs("Content.compare", args, kwargs, "path_a", &pathA, "path_b", &pathB)
+	if err != nil {
+		return nil, err
+	}
+
+	var files [2]*os.File
+	var dones [2]func(error) error
+	for i, path := range []starlark.String{pathA, pathB} {
+		fpath, err := c.RealPath(path.GoString(), CheckRead)
+		if err != nil {
+			return nil, err
+		}
+		files[i], dones[i], err = c.openFile(fpath, "read")
+		if err != nil {
+			return nil, c.polishError(path, err)
+		}
+		defer files[i].Close()
+	}
+	same, errs := compareFiles(files[0], files[1])
+	for i, path := range []starlark.String{pathA, pathB} {
+		if err := dones[i](errs[i]); err != nil {
+			return nil, c.polishError(path, err)
+		}
+	}
+	return starlark.Bool(same), nil
+}
+
+// Diff returns a unified diff from the file at path to either the file
+// at other or the provided data, or an empty string if they are equal.
+func (c *ContentValue) Diff(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var other, data Value = starlark.None, starlark.None
+	err := starlark.UnpackArgs("Content.diff", args, kwargs, "path", &path, "other?", &other, "data?", &data)
+	if err != nil {
+		return nil, err
+	}
+	if (other == starlark.None) == (data == starlark.None) {
+		return nil, fmt.Errorf("Content.diff: must provide either other or data")
+	}
+
+	fpath, err := c.RealPath(path.GoString(), CheckRead)
+	if err != nil {
+		return nil, err
+	}
+	old, err := c.readFile(path, fpath)
+	if err != nil {
+		return nil, err
+	}
+	var newName, new string
+	if data != starlark.None {
+		s, ok := starlark.AsString(data)
+		if !ok {
+			return nil, fmt.Errorf("Content.diff: for parameter data: got %s, want string", data.Type())
+		}
+		newName, new = "data", s
+	} else {
+		s, ok := starlark.AsString(other)
+		if !ok {
+			return nil, fmt.Errorf("Content.diff: for parameter other: got %s, want string", other.Type())
+		}
+		opath, err := c.RealPath(s, CheckRead)
+		if err != nil {
+			return nil, err
+		}
+		b, err := c.readFile(starlark.String(s), opath)
+		if err != nil {
+			return nil, err
+		}
+		newName, new = s, string(b)
+	}
+	return starlark.String(unifiedDiff(path.GoString(), string(old), newName, new)), nil
+}
+
+// compareFiles returns whether a and b have the same data, along with
+// the errors found while reading each of them.
+func compareFiles(a, b *os.File) (same bool, errs [2]error) {
+	infoA, errA := a.Stat()
+	infoB, errB := b.Stat()
+	if errA != nil || errB != nil {
+		return false, [2]error{errA, errB}
+	}
+	regular := infoA.Mode().IsRegular() && infoB.Mode().IsRegular()
+	if regular && infoA.Size() != infoB.Size() {
+		return false, errs
+	}
+	const chunkSize = 32 * 1024
+	bufA := make([]byte, chunkSize)
+	bufB := make([]byte, chunkSize)
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		nB, errB := io.ReadFull(b, bufB)
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			errA = nil
+		}
+		if errB == io.EOF || errB == io.ErrUnexpectedEOF {
+			errB = nil
+		}
+		if errA != nil || errB != nil {
+			return false, [2]error{errA, errB}
+		}
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return false, errs
+		}
+		if nA < chunkSize {
+			return true, errs
+		}
+	}
+}
+
+// Walk traverses the tree under the given directory, calling fn for each
+// directory found with its path and the list of entry names, as returned
+// by Content.list. The fn callback may return a list of subdirectory names
+// that should not be traversed, or None to traverse all of them. If
+// maxdepth is not negative, at most that many levels of subdirectories
+// are traversed, so zero only visits the given directory.
+func (c *ContentValue) Walk(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var callback starlark.Callable
+	var maxDepth = -1
+	err := starlark.UnpackArgs("Content.walk", args, kwargs, "path", &path, "fn", &callback, "maxdepth?", &maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	err = c.walk(thread, dirPath(path.GoString()), callback, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+func (c *ContentValue) walk(thread *starlark.Thread, dir string, callback starlark.Callable, maxDepth int) error {
+	fpath, err := c.RealPath(dir, CheckRead)
+	if err != nil {
+		return err
+	}
+	entries, err := c.readDir(starlark.String(dir), fpath)
+	if err != nil {
+		return err
+	}
+	names := make([]Value, len(entries))
+	for i, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		names[i] = starlark.String(name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].(starlark.String) < names[j].(starlark.String)
+	})
+	result, err := starlark.Call(thread, callback, starlark.Tuple{starlark.String(dir), starlark.NewList(names)}, nil)
+	if err != nil {
+		return err
+	}
+	prune := make(map[string]bool)
+	if result != starlark.None {
+		iterable, ok := result.(starlark.Iterable)
+		if !ok {
+			return fmt.Errorf("Content.walk: callback must return a list of names or None, got %s", result.Type())
+		}
+		iter := iterable.Iterate()
+		defer iter.Done()
+		var value Value
+		for iter.Next(&value) {
+			name, ok := starlark.AsString(value)
+			if !ok {
+				return fmt.Errorf("Content.walk: callback must return a list of names or None, got %s in list", value.Type())
+			}
+			prune[strings.TrimSuffix(name, "/")] = true
+		}
+	}
+	if maxDepth == 0 {
+		return nil
+	}
+	for _, name := range names {
+		name := string(name.(starlark.String))
+		if !strings.HasSuffix(name, "/") || prune[strings.TrimSuffix(name, "/")] {
+			continue
+		}
+		err = c.walk(thread, dir+name, callback, maxDepth-1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
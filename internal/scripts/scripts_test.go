@@ -1,12 +1,27 @@
 package scripts_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
 
+	"go.starlark.net/starlark"
 	. "gopkg.in/check.v1"
 
+	"github.com/canonical/chisel/internal/fsutil"
 	"github.com/canonical/chisel/internal/scripts"
 	"github.com/canonical/chisel/internal/testutil"
 )
@@ -44,6 +59,28 @@ var scriptsTests = []scriptsTest{{
 		"/foo/file1.txt": "file 0644 5b41362b",
 		"/foo/file2.txt": "file 0644 d98cf53e",
 	},
+}, {
+	summary: "Write new files exclusively",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.write("/foo/file2.txt", "data1", exclusive=True)
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/file2.txt": "file 0644 5b41362b",
+	},
+}, {
+	summary: "Exclusive writes refuse to overwrite files",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.write("/foo/file1.txt", "data2", exclusive=True)
+	`,
+	error: `open /foo/file1.txt: file exists`,
 }, {
 	summary: "Read a file",
 	content: map[string]string{
@@ -59,6 +96,38 @@ var scriptsTests = []scriptsTest{{
 		"/foo/file1.txt": "file 0644 5b41362b",
 		"/foo/file2.txt": "file 0644 5b41362b",
 	},
+}, {
+	summary: "Read with a default",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+		"foo/file2.txt": ``,
+	},
+	script: `
+		data = content.read("/foo/file1.txt", default="data2")
+		data += content.read("/foo/missing.txt", default="data2")
+		data += content.read("/missing/file.txt", default="")
+		content.write("/foo/file2.txt", data)
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/file2.txt": "file 0644 53ddc036", // data1data2
+	},
+}, {
+	summary: "Read with a default still fails on other errors",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.read("/foo", default="data2")
+	`,
+	error: `read /foo: is a directory`,
+}, {
+	summary: "Read default must be a string",
+	script: `
+		content.read("/missing.txt", default=None)
+	`,
+	error: `Content.read: for parameter default: got NoneType, want string`,
 }, {
 	summary: "List a directory",
 	content: map[string]string{
@@ -78,170 +147,3581 @@ var scriptsTests = []scriptsTest{{
 		"/bar/file3.txt": "file 0644 5b41362b",
 	},
 }, {
-	summary: "Forbid relative paths",
+	summary: "List a directory in lexical order",
+	content: map[string]string{
+		"foo/bar/file1.txt": `data1`,
+		"foo/bar-x":         `data1`,
+		"foo/bar.txt":       `data1`,
+		"foo/bar0":          `data1`,
+	},
+	script: `
+		content.write("/out.txt", ",".join(content.list("/foo")))
+	`,
+	result: map[string]string{
+		"/foo/":              "dir 0755",
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file1.txt": "file 0644 5b41362b",
+		"/foo/bar-x":         "file 0644 5b41362b",
+		"/foo/bar.txt":       "file 0644 5b41362b",
+		"/foo/bar0":          "file 0644 5b41362b",
+		"/out.txt":           "file 0644 1e19af97", // "bar-x,bar.txt,bar/,bar0"
+	},
+}, {
+	summary: "List only files or directories",
+	content: map[string]string{
+		"foo/bar/file1.txt": `data1`,
+		"foo/baz/file2.txt": `data1`,
+		"foo/file3.txt":     `data1`,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("file3.txt", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		files = content.list("/foo", files_only=True)
+		dirs = content.list("/foo", dirs_only=True)
+		content.write("/out.txt", ",".join(files) + " " + ",".join(dirs))
+	`,
+	result: map[string]string{
+		"/foo/":              "dir 0755",
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file1.txt": "file 0644 5b41362b",
+		"/foo/baz/":          "dir 0755",
+		"/foo/baz/file2.txt": "file 0644 5b41362b",
+		"/foo/file3.txt":     "file 0644 5b41362b",
+		"/foo/link":          "symlink file3.txt",
+		"/out.txt":           "file 0644 c9f738b6", // "file3.txt bar/,baz/"
+	},
+}, {
+	summary: "List type filters are mutually exclusive",
+	script: `
+		content.list("/", files_only=True, dirs_only=True)
+	`,
+	error: `Content.list: cannot use both files_only and dirs_only`,
+}, {
+	summary: "List entries matching a pattern",
+	content: map[string]string{
+		"foo/bar/file1.txt": `data1`,
+		"foo/baz.txt":       `data1`,
+		"foo/file2.conf":    `data1`,
+		"foo/file3.txt":     `data1`,
+	},
+	script: `
+		txt = content.list("/foo", pattern="*.txt")
+		ba = content.list("/foo", pattern="ba[rz]*", dirs_only=True)
+		content.write("/out.txt", ",".join(txt) + " " + ",".join(ba))
+	`,
+	result: map[string]string{
+		"/foo/":              "dir 0755",
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file1.txt": "file 0644 5b41362b",
+		"/foo/baz.txt":       "file 0644 5b41362b",
+		"/foo/file2.conf":    "file 0644 5b41362b",
+		"/foo/file3.txt":     "file 0644 5b41362b",
+		"/out.txt":           "file 0644 88687cb4", // "baz.txt,file3.txt bar/"
+	},
+}, {
+	summary: "List patterns are checked up front",
+	script: `
+		content.list("/missing", pattern="*.[txt")
+	`,
+	error: `Content.list: invalid pattern: \*\.\[txt`,
+}, {
+	summary: "List entries by extension",
+	content: map[string]string{
+		"foo/rules.conf/file1.txt": `data1`,
+		"foo/file2.conf":           `data1`,
+		"foo/file3.txt":            `data1`,
+		"foo/file4.CONF":           `data1`,
+		"foo/conf":                 `data1`,
+	},
+	script: `
+		a = content.by_extension("/foo", "conf")
+		b = content.by_extension("/foo", ".CONF", ignore_case=True)
+		content.write("/out.txt", ",".join(a) + " " + ",".join(b))
+	`,
+	result: map[string]string{
+		"/foo/":                     "dir 0755",
+		"/foo/conf":                 "file 0644 5b41362b",
+		"/foo/file2.conf":           "file 0644 5b41362b",
+		"/foo/file3.txt":            "file 0644 5b41362b",
+		"/foo/file4.CONF":           "file 0644 5b41362b",
+		"/foo/rules.conf/":          "dir 0755",
+		"/foo/rules.conf/file1.txt": "file 0644 5b41362b",
+		"/out.txt":                  "file 0644 087dffb6", // "file2.conf,rules.conf/ file2.conf,file4.CONF,rules.conf/"
+	},
+}, {
+	summary: "List by extension requires an extension",
+	script: `
+		content.by_extension("/", ".")
+	`,
+	error: `Content.by_extension: empty extension`,
+}, {
+	summary: "Disk usage of a tree",
+	content: map[string]string{
+		"foo/file1.txt":     `data1`,
+		"foo/bar/file2.txt": `data2`,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("bar/file2.txt", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		total = content.du("/foo")
+		followed = content.du("/foo", follow_symlinks=True)
+		single = content.du("/foo/file1.txt")
+		content.write("/foo/file1.txt", str(total))
+		content.write("/foo/bar/file2.txt", str(followed))
+		content.write("/out.txt", str(single))
+	`,
+	result: map[string]string{
+		"/foo/":              "dir 0755",
+		"/foo/file1.txt":     "file 0644 4a44dc15", // "10"
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file2.txt": "file 0644 e629fa65", // "15"
+		"/foo/link":          "symlink bar/file2.txt",
+		"/out.txt":           "file 0644 ef2d127d", // "5"
+	},
+}, {
+	summary: "Find entries matching a predicate",
+	content: map[string]string{
+		"foo/file1.txt":     `data1`,
+		"foo/file2.conf":    `data1`,
+		"foo/bar/file3.txt": `data1`,
+	},
+	script: `
+		def is_dir(path):
+			return path.endswith("/")
+		content.write("/foo/file1.txt", ",".join(content.find("/foo", lambda p: p.endswith(".txt"))))
+		content.write("/foo/file2.conf", ",".join(content.find("/foo/", is_dir)))
+	`,
+	result: map[string]string{
+		"/foo/":              "dir 0755",
+		"/foo/file1.txt":     "file 0644 4c1b4d08", // "/foo/bar/file3.txt,/foo/file1.txt"
+		"/foo/file2.conf":    "file 0644 f10c77a5", // "/foo/bar/"
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file3.txt": "file 0644 5b41362b",
+	},
+}, {
+	summary: "Find propagates predicate errors",
 	content: map[string]string{
 		"foo/file1.txt": `data1`,
 	},
 	script: `
-		content.read("foo/file1.txt")
+		content.find("/foo", lambda p: 1 // 0)
 	`,
-	error: `content path must be absolute, got: foo/file1.txt`,
+	error: `floored division by zero`,
 }, {
-	summary: "Forbid leaving the content root",
+	summary: "Operate on a sub-root",
+	content: map[string]string{
+		"foo/bar/file1.txt": `data1`,
+	},
+	script: `
+		def helper(c):
+			c.write("/file2.txt", c.read("/file1.txt"))
+		helper(content.sub("/foo/bar/"))
+		content.sub("/foo").write("/file3.txt", ",".join(content.sub("/").list("/foo/bar")))
+	`,
+	result: map[string]string{
+		"/foo/":              "dir 0755",
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file1.txt": "file 0644 5b41362b",
+		"/foo/bar/file2.txt": "file 0644 5b41362b",
+		"/foo/file3.txt":     "file 0644 98139a06", // "file1.txt,file2.txt"
+	},
+}, {
+	summary: "Sub-roots cannot leave their root",
 	content: map[string]string{
 		"foo/file1.txt": `data1`,
+		"bar/file2.txt": `data2`,
 	},
 	script: `
-		content.read("/foo/../../file1.txt")
+		content.sub("/foo").read("/../bar/file2.txt")
 	`,
-	error: `invalid content path: /foo/../../file1.txt`,
+	error: `invalid content path: /../bar/file2.txt`,
 }, {
-	summary: "Forbid leaving the content via bad symlinks",
+	summary: "Sub-roots rebase checks",
 	content: map[string]string{
-		"foo/file3.txt": ``,
+		"foo/file1.txt": `data1`,
 	},
-	hackdir: func(c *C, dir string) {
-		fpath1 := filepath.Join(dir, "foo/file1.txt")
-		fpath2 := filepath.Join(dir, "foo/file2.txt")
-		c.Assert(os.Symlink("file2.txt", fpath1), IsNil)
-		c.Assert(os.Symlink("../../bar", fpath2), IsNil)
+	script: `
+		content.sub("/foo").write("/file1.txt", "data2")
+	`,
+	checkw: func(p string) error { return fmt.Errorf("no write: %s", p) },
+	error:  `no write: /foo/file1.txt`,
+}, {
+	summary: "Sub-roots must be directories",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
 	},
 	script: `
-		content.read("/foo/file1.txt")
+		content.sub("/foo/file1.txt")
 	`,
-	error: `invalid content symlink: /foo/file2.txt`,
+	error: `content path is not a directory: /foo/file1.txt`,
 }, {
-	summary: "Path errors refer to the root",
+	summary: "Write JSON",
 	content: map[string]string{},
 	script: `
-		content.read("/foo/file1.txt")
+		content.write_json("/file1.json", {"b": "x", "a": [1, True, None]})
+		content.write_json("/file2.json", {"a": [1]}, indent=2)
 	`,
-	error: `open /foo/file1.txt: no such file or directory`,
+	result: map[string]string{
+		"/file1.json": "file 0644 d8e64884", // "{\"a\":[1,true,null],\"b\":\"x\"}\n"
+		"/file2.json": "file 0644 5b651174", // "{\n  \"a\": [\n    1\n  ]\n}\n"
+	},
 }, {
-	summary: "Check reads",
+	summary: "Write JSON rejects unserializable values",
+	content: map[string]string{},
+	script: `
+		content.write_json("/file1.json", {"a": lambda: 1})
+	`,
+	error: `cannot encode /file1.json as JSON: json.encode: in dict key "a": cannot encode function as JSON`,
+}, {
+	summary: "Read JSON",
 	content: map[string]string{
-		"bar/file1.txt": `data1`,
+		"config.json": `{"b": "data2", "a": ["data1", 1, true, null]}`,
 	},
 	script: `
-		content.write("/foo/../bar/file2.txt", "data2")
-		content.read("/foo/../bar/file2.txt")
+		config = content.read_json("/config.json", max_size=100)
+		if config["a"][1:] != [1, True, None]:
+			fail("unexpected value: %r", config)
+		content.write("/out.txt", config["a"][0] + config["b"])
 	`,
-	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
-	error:  `no read: /bar/file2.txt`,
+	result: map[string]string{
+		"/config.json": "file 0644 69326572",
+		"/out.txt":     "file 0644 53ddc036", // data1data2
+	},
 }, {
-	summary: "Check writes",
+	summary: "Read JSON reports the offset of syntax errors",
 	content: map[string]string{
-		"bar/file1.txt": `data1`,
+		"config.json": `{"a": }`,
 	},
 	script: `
-		content.read("/foo/../bar/file1.txt")
-		content.write("/foo/../bar/file1.txt", "data1")
+		content.read_json("/config.json")
 	`,
-	checkw: func(p string) error { return fmt.Errorf("no write: %s", p) },
-	error:  `no write: /bar/file1.txt`,
+	error: `cannot decode /config.json as JSON: json.decode: at offset 6, unexpected character .*`,
 }, {
-	summary: "Check lists",
+	summary: "Read JSON enforces a maximum size",
 	content: map[string]string{
-		"bar/file1.txt": `data1`,
+		"config.json": `{"a": 1}`,
 	},
 	script: `
-		content.write("/foo/../bar/file2.txt", "data2")
-		content.list("/foo/../bar/")
+		content.read_json("/config.json", max_size=7)
 	`,
-	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
-	error:  `no read: /bar/`,
+	error: `cannot decode /config.json as JSON: file exceeds 7 bytes`,
 }, {
-	summary: "Check lists",
+	summary: "Verify the digest of a file",
 	content: map[string]string{
-		"bar/file1.txt": `data1`,
+		"foo/file1.txt": `data1`,
 	},
 	script: `
-		content.write("/foo/../bar/file2.txt", "data2")
-		content.list("/foo/../bar")
+		ok1 = content.verify("/foo/file1.txt", "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9")
+		ok2 = content.verify("/foo/file1.txt", "5B41362BC82B7F3D56EDC5A306DB22105707D01FF4819E26FAEF9724A2D406C9", algo="sha256")
+		ok3 = content.verify("/foo/file1.txt", "9731b541b22c1d7042646ab2ee17685bbb664bced666d8ecf3593f3ef46493deef651b0f31b6cff8c4df8dcb425a1035e86ddb9877a8685647f39847be0d7c01", algo="sha512")
+		bad = content.verify("/foo/file1.txt", "d98cf53e0c8b77c14a96358d5b69584225b4bb9026423cbc2f7b0161894c402c", required=False)
+		content.write("/foo/out.txt", "%s %s" % (ok1 and ok2 and ok3, bad))
 	`,
-	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
-	error:  `no read: /bar/`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/out.txt":   "file 0644 8f151f94", // True False
+	},
 }, {
-	summary: "Check reads on symlinks",
+	summary: "Verify fails on digest mismatch",
 	content: map[string]string{
-		"foo/file2.txt": ``,
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.verify("/foo/file1.txt", "d98cf53e0c8b77c14a96358d5b69584225b4bb9026423cbc2f7b0161894c402c")
+	`,
+	error: `digest mismatch for /foo/file1.txt: expected d98cf53e0c8b77c14a96358d5b69584225b4bb9026423cbc2f7b0161894c402c got 5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9`,
+}, {
+	summary: "Verify rejects malformed digests",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.verify("/foo/file1.txt", "5b41362b")
+	`,
+	error: `Content.verify: invalid sha256 digest: "5b41362b"`,
+}, {
+	summary: "Verify rejects unknown algorithms",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.verify("/foo/file1.txt", "5b41362b", algo="md5")
+	`,
+	error: `Content.verify: unsupported algorithm: "md5"`,
+}, {
+	summary: "Append lines to files",
+	content: map[string]string{
+		"foo/file1.txt": "data1",
+		"foo/file3.txt": "line1\nline2\n",
+	},
+	script: `
+		r1 = content.append_line("/foo/file1.txt", "line2")
+		r2 = content.append_line("/foo/file1.txt", "line2", unique=True)
+		r3 = content.append_line("/foo/file2.txt", "line2\n")
+		r4 = content.append_line("/foo/file3.txt", "line2", unique=True)
+		content.write("/foo/out.txt", "%s %s %s %s" % (r1, r2, r3, r4))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 ede30547", // data1\nline2\n
+		"/foo/file2.txt": "file 0644 5f2d8fbf", // line2\n
+		"/foo/file3.txt": "file 0644 2751a3a2",
+		"/foo/out.txt":   "file 0644 075e15a4", // True False True False
+	},
+}, {
+	summary: "Append line rejects embedded newlines",
+	script: `
+		content.append_line("/file1.txt", "line1\nline2")
+	`,
+	error: `Content.append_line: line must not contain newlines`,
+}, {
+	summary: "Read all files in a tree",
+	content: map[string]string{
+		"foo/file1.txt":     `data1`,
+		"foo/bar/file2.txt": `data2`,
+		"foo/bar/file3.bin": "\xff",
+		"baz/file4.txt":     `data3`,
 	},
 	hackdir: func(c *C, dir string) {
-		fpath1 := filepath.Join(dir, "foo/file1.txt")
-		c.Assert(os.Symlink("file2.txt", fpath1), IsNil)
+		c.Assert(os.Symlink("file1.txt", filepath.Join(dir, "foo/link")), IsNil)
 	},
 	script: `
-		content.read("/foo/file1.txt")
+		files = content.readall("/foo", max_total_size=11)
+		content.write("/out.txt", repr(files))
 	`,
-	checkr: func(p string) error {
-		if p == "/foo/file2.txt" {
-			return fmt.Errorf("no read: %s", p)
-		}
-		return nil
+	result: map[string]string{
+		"/baz/":              "dir 0755",
+		"/baz/file4.txt":     "file 0644 f60f2d65",
+		"/foo/":              "dir 0755",
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file2.txt": "file 0644 d98cf53e",
+		"/foo/bar/file3.bin": "file 0644 a8100ae6",
+		"/foo/file1.txt":     "file 0644 5b41362b",
+		"/foo/link":          "symlink file1.txt",
+		"/out.txt":           "file 0644 47157e26", // {"/foo/bar/file2.txt": "data2", "/foo/bar/file3.bin": b"\xff", "/foo/file1.txt": "data1"}
 	},
-	error: `no read: /foo/file2.txt`,
 }, {
-	summary: "Check writes on symlinks",
+	summary: "Read all files enforces a maximum total size",
 	content: map[string]string{
-		"foo/file2.txt": ``,
+		"foo/file1.txt": `data1`,
+		"foo/file2.txt": `data2`,
+	},
+	script: `
+		content.readall("/foo", max_total_size=9)
+	`,
+	error: `Content.readall: total size exceeds 9 bytes`,
+}, {
+	summary: "Read lines",
+	content: map[string]string{
+		"foo/file1.txt": "a\n\r\nb",
+	},
+	script: `
+		lines = content.read_lines("/foo/file1.txt")
+		content.write("/file2.txt", str(content.read_lines("/foo/file1.txt", keepends=True)))
+		content.write("/foo/file1.txt", str(lines))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 f61a4962", // "[\"a\", \"\", \"b\"]"
+		"/file2.txt":     "file 0644 e4af81c4", // "[\"a\\n\", \"\\r\\n\", \"b\"]"
+	},
+}, {
+	summary: "Find matching lines with grep",
+	content: map[string]string{
+		"foo/file1.txt": "foo=1\r\nbar=2\nfoo=3\n",
+	},
+	script: `
+		content.write("/foo/out1.txt", str(content.grep("/foo/file1.txt", "foo")))
+		content.write("/foo/out2.txt", str(content.grep("/foo/file1.txt", "^b.*[0-9]$", regex=True)))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 a91ead4d",
+		"/foo/out1.txt":  "file 0644 dd039f1c", // "[(1, \"foo=1\"), (3, \"foo=3\")]"
+		"/foo/out2.txt":  "file 0644 5044744d", // "[(2, \"bar=2\")]"
+	},
+}, {
+	summary: "Grep rejects invalid patterns",
+	content: map[string]string{
+		"foo/file1.txt": "foo",
+	},
+	script: `
+		content.grep("/foo/file1.txt", "(", regex=True)
+	`,
+	error: `Content.grep: invalid pattern: error parsing regexp: missing closing \): .*`,
+}, {
+	summary: "Read typed directory entries",
+	content: map[string]string{
+		"foo/file1.txt":     `data1`,
+		"foo/bar/file2.txt": `data2`,
 	},
 	hackdir: func(c *C, dir string) {
-		fpath1 := filepath.Join(dir, "foo/file1.txt")
-		c.Assert(os.Symlink("file2.txt", fpath1), IsNil)
+		c.Assert(os.Symlink("file1.txt", filepath.Join(dir, "foo/link")), IsNil)
 	},
 	script: `
-		content.write("/foo/file1.txt", "")
+		lines = []
+		for entry in content.readdir("/foo"):
+			line = "%s %s %s" % (entry.name, entry.is_dir, entry.is_symlink)
+			if not entry.is_dir and not entry.is_symlink:
+				line += " %d" % entry.size
+			lines.append(line + "\n")
+		content.write("/out.txt", "".join(lines))
 	`,
-	checkw: func(p string) error {
-		if p == "/foo/file2.txt" {
-			return fmt.Errorf("no write: %s", p)
-		}
-		return nil
+	result: map[string]string{
+		"/foo/":              "dir 0755",
+		"/foo/file1.txt":     "file 0644 5b41362b",
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file2.txt": "file 0644 d98cf53e",
+		"/foo/link":          "symlink file1.txt",
+		"/out.txt":           "file 0644 0a49f001", // "bar True False\nfile1.txt False False 5\nlink False True\n"
 	},
-	error: `no write: /foo/file2.txt`,
-}}
-
-func (s *S) TestScripts(c *C) {
-	for _, test := range scriptsTests {
-		c.Logf("Summary: %s", test.summary)
-
-		rootDir := c.MkDir()
-		for path, data := range test.content {
-			fpath := filepath.Join(rootDir, path)
-			err := os.MkdirAll(filepath.Dir(fpath), 0755)
-			c.Assert(err, IsNil)
-			err = os.WriteFile(fpath, []byte(data), 0644)
-			c.Assert(err, IsNil)
-		}
-		if test.hackdir != nil {
-			test.hackdir(c, rootDir)
-		}
-
-		content := &scripts.ContentValue{
-			RootDir:    rootDir,
-			CheckRead:  test.checkr,
-			CheckWrite: test.checkw,
+}, {
+	summary: "Check for existence with the in operator",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("missing.txt", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		found = ["/foo/" in content, "/foo/file1.txt" in content, "/foo/link" in content]
+		found += ["/foo/file2.txt" in content, "/bar/" in content]
+		content.write("/out.txt", " ".join([str(f) for f in found]))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/link":      "symlink missing.txt",
+		"/out.txt":       "file 0644 f3a2ab35", // "True True True False False"
+	},
+}, {
+	summary: "Check reads with the in operator",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		"/foo/file2.txt" in content
+	`,
+	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
+	error:  `no read: /foo/file2.txt`,
+}, {
+	summary: "The in operator requires strings",
+	script: `
+		1 in content
+	`,
+	error: `'in Content' requires string as left operand, not int`,
+}, {
+	summary: "Check entry types with is_dir and is_file",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("file1.txt", filepath.Join(dir, "foo/link")), IsNil)
+		c.Assert(os.Symlink("foo", filepath.Join(dir, "dirlink")), IsNil)
+	},
+	script: `
+		paths = ["/foo/", "/foo/file1.txt", "/dirlink"]
+		lines = []
+		for fn in [content.is_dir, content.is_file]:
+			found = []
+			for path in paths:
+				found += [fn(path), fn(path, follow_symlinks=False)]
+			lines.append(" ".join([str(f) for f in found]))
+		lines.append(" ".join([str(content.is_file("/foo/link")), str(content.is_dir("/missing"))]))
+		content.write("/out.txt", "\n".join(lines) + "\n")
+	`,
+	result: map[string]string{
+		"/dirlink":       "symlink foo",
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/link":      "symlink file1.txt",
+		"/out.txt":       "file 0644 4bc63a66", // "True True False False True False\nFalse False True True False False\nTrue False\n"
+	},
+}, {
+	summary: "Check whether files and directories are empty",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+		"foo/file2.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Mkdir(filepath.Join(dir, "bar"), 0755), IsNil)
+	},
+	script: `
+		paths = ["/foo/file1.txt", "/foo/file2.txt", "/foo", "/bar/"]
+		content.write("/out.txt", " ".join([str(content.is_empty(p)) for p in paths]))
+	`,
+	result: map[string]string{
+		"/bar/":          "dir 0755",
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/file2.txt": "file 0644 empty",
+		"/out.txt":       "file 0644 d77dab08", // "False True False True"
+	},
+}, {
+	summary: "Checking whether a missing path is empty fails",
+	script: `
+		content.is_empty("/missing")
+	`,
+	error: `stat /missing: no such file or directory`,
+}, {
+	summary: "Content values are unhashable",
+	script: `
+		{content: 1}
+	`,
+	error: `unhashable type: Content`,
+}, {
+	summary: "Content values are only equal to themselves",
+	script: `
+		if content != content:
+			fail("unexpected equality")
+		if content.sub("/foo") == content.sub("/foo"):
+			fail("unexpected equality")
+	`,
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+	},
+}, {
+	summary: "Iterate over root entries",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+		"bar.txt":       `data1`,
+	},
+	script: `
+		content.write("/out.txt", " ".join(sorted(content)))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/bar.txt":       "file 0644 5b41362b",
+		"/out.txt":       "file 0644 c9abbb5f", // "bar.txt foo/"
+	},
+}, {
+	summary: "Iteration requires the root to be readable",
+	script: `
+		for name in content:
+			pass
+	`,
+	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
+	error:  `no read: /`,
+}, {
+	summary: "Count entries matching a glob",
+	content: map[string]string{
+		"foo/file1.so":       `data1`,
+		"foo/file2.txt":      `data1`,
+		"foo/bar/file3.so":   `data1`,
+		"foo/bar/baz/lib.so": `data1`,
+	},
+	script: `
+		counts = [
+			content.glob_count("/foo/**.so"),
+			content.glob_count("/foo/*/"),
+			content.glob_count("/foo/*.so"),
+			content.glob_count("/foo/*/*"),
+			content.glob_count("/foo/**/"),
+			content.glob_count("/missing/**"),
+			content.glob_count("/foo/file1.so/*"),
+			content.glob_count("/foo/file2.txt"),
+		]
+		content.write("/out.txt", " ".join([str(n) for n in counts]))
+	`,
+	result: map[string]string{
+		"/foo/":               "dir 0755",
+		"/foo/file1.so":       "file 0644 5b41362b",
+		"/foo/file2.txt":      "file 0644 5b41362b",
+		"/foo/bar/":           "dir 0755",
+		"/foo/bar/file3.so":   "file 0644 5b41362b",
+		"/foo/bar/baz/":       "dir 0755",
+		"/foo/bar/baz/lib.so": "file 0644 5b41362b",
+		"/out.txt":            "file 0644 ba30e323", // "3 1 1 1 2 0 0 1"
+	},
+}, {
+	summary: "Stat entries matching a glob",
+	content: map[string]string{
+		"foo/file1.so":       `data1`,
+		"foo/file2.txt":      `data1`,
+		"foo/bar/file3.so":   `data12`,
+		"foo/bar/baz/lib.so": `data1`,
+	},
+	script: `
+		libs = content.glob_stat("/foo/**.so")
+		dirs = content.glob_stat("/foo/*/")
+		libs = sorted(libs, key=lambda s: s.path)
+		line = ",".join(["%s %d %s" % (s.path, s.size, s.is_dir) for s in libs])
+		line += " " + ",".join(["%s %s" % (s.path, s.is_dir) for s in dirs])
+		content.write("/out.txt", line)
+	`,
+	result: map[string]string{
+		"/foo/":               "dir 0755",
+		"/foo/file1.so":       "file 0644 5b41362b",
+		"/foo/file2.txt":      "file 0644 5b41362b",
+		"/foo/bar/":           "dir 0755",
+		"/foo/bar/file3.so":   "file 0644 f4c7ef27",
+		"/foo/bar/baz/":       "dir 0755",
+		"/foo/bar/baz/lib.so": "file 0644 5b41362b",
+		"/out.txt":            "file 0644 7fa1d30c", // "/foo/bar/baz/lib.so 5 False,/foo/bar/file3.so 6 False,/foo/file1.so 5 False /foo/bar/ True"
+	},
+}, {
+	summary: "Glob patterns must be absolute",
+	script: `
+		content.glob_count("foo/*")
+	`,
+	error: `content path must be absolute, got: foo/\*`,
+}, {
+	summary: "Resolve symlinks in path components",
+	content: map[string]string{
+		"usr/lib/libx.so": `data1`,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("usr/lib", filepath.Join(dir, "lib")), IsNil)
+		c.Assert(os.Symlink("/usr/lib/libx.so", filepath.Join(dir, "usr/lib/abs")), IsNil)
+	},
+	script: `
+		lines = []
+		for path in ["/lib/abs", "/lib/missing/x", "/usr/./lib/"]:
+			r = content.resolve(path)
+			lines.append("%s %s" % (r.path, r.symlinks))
+		content.write("/out.txt", "\n".join(lines))
+	`,
+	result: map[string]string{
+		"/lib":             "symlink usr/lib",
+		"/usr/":            "dir 0755",
+		"/usr/lib/":        "dir 0755",
+		"/usr/lib/abs":     "symlink /usr/lib/libx.so",
+		"/usr/lib/libx.so": "file 0644 5b41362b",
+		// "/usr/lib/libx.so [(\"/lib\", \"usr/lib\"), (\"/usr/lib/abs\", \"/usr/lib/libx.so\")]\n" +
+		// "/usr/lib/missing/x [(\"/lib\", \"usr/lib\")]\n" +
+		// "/usr/lib []"
+		"/out.txt": "file 0644 bed255b6",
+	},
+}, {
+	summary: "Resolve detects symlink loops",
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("loop2", filepath.Join(dir, "loop1")), IsNil)
+		c.Assert(os.Symlink("loop1", filepath.Join(dir, "loop2")), IsNil)
+	},
+	script: `
+		content.resolve("/loop1/x")
+	`,
+	error: `resolve /loop1: too many levels of symbolic links`,
+}, {
+	summary: "Symlink loops are reported",
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("loop2", filepath.Join(dir, "loop1")), IsNil)
+		c.Assert(os.Symlink("loop1", filepath.Join(dir, "loop2")), IsNil)
+	},
+	script: `
+		content.read("/loop2")
+	`,
+	error: `resolve /loop2: too many levels of symbolic links`,
+}, {
+	summary: "Resolve enforces containment",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("../..", filepath.Join(dir, "foo/up")), IsNil)
+	},
+	script: `
+		content.resolve("/foo/up/x")
+	`,
+	error: `invalid content symlink: /foo/up`,
+}, {
+	summary: "Diff files and data",
+	content: map[string]string{
+		"foo/file1.txt": "a\nb\nc\nd\n",
+		"foo/file2.txt": "a\nB\nc\nd\ne",
+	},
+	script: `
+		content.write("/out1.diff", content.diff("/foo/file1.txt", "/foo/file2.txt"))
+		content.write("/out2.diff", content.diff("/foo/file1.txt", data=""))
+		content.write("/out3.diff", content.diff("/foo/file1.txt", data="a\nb\nc\nd\n"))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 cf2c7f63",
+		"/foo/file2.txt": "file 0644 5e181469",
+		// "--- /foo/file1.txt\n+++ /foo/file2.txt\n@@ -1,4 +1,5 @@\n" +
+		// " a\n-b\n+B\n c\n d\n+e\n\\ No newline at end of file\n"
+		"/out1.diff": "file 0644 74f2f9e5",
+		// "--- /foo/file1.txt\n+++ data\n@@ -1,4 +0,0 @@\n-a\n-b\n-c\n-d\n"
+		"/out2.diff": "file 0644 33968c33",
+		"/out3.diff": "file 0644 empty",
+	},
+}, {
+	summary: "Diff requires one of other or data",
+	content: map[string]string{
+		"foo/file1.txt": "a\n",
+	},
+	script: `
+		content.diff("/foo/file1.txt")
+	`,
+	error: `Content.diff: must provide either other or data`,
+}, {
+	summary: "Count directory entries",
+	content: map[string]string{
+		"foo/file1.txt":     `data1`,
+		"foo/file2.txt":     `data1`,
+		"foo/bar/file3.txt": `data1`,
+	},
+	script: `
+		content.write("/foo/bar/file3.txt", "%d %d" % (content.count("/foo"), content.count("/foo/bar/.")))
+	`,
+	result: map[string]string{
+		"/foo/":              "dir 0755",
+		"/foo/file1.txt":     "file 0644 5b41362b",
+		"/foo/file2.txt":     "file 0644 5b41362b",
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file3.txt": "file 0644 290a8619", // "3 1"
+	},
+}, {
+	summary: "Replace text in files",
+	content: map[string]string{
+		"foo/file1.txt": "a=1\nb=1\na=1\n",
+		"foo/file2.txt": "a=1\nb=1\na=1\n",
+	},
+	script: `
+		n1 = content.replace("/foo/file1.txt", "a=1", "a=2")
+		n2 = content.replace("/foo/file2.txt", "a=1", "c=1", count=1)
+		n3 = content.replace("/foo/file2.txt", "zzz", "")
+		content.write("/out.txt", "%d %d %d" % (n1, n2, n3))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 2dbe24d3", // "a=2\nb=1\na=2\n"
+		"/foo/file2.txt": "file 0644 9ef13774", // "c=1\nb=1\na=1\n"
+		"/out.txt":       "file 0644 1c8bbd91", // "2 1 0"
+	},
+}, {
+	summary: "Replace requiring a match",
+	content: map[string]string{
+		"foo/file1.txt": "a=1\n",
+	},
+	script: `
+		content.replace("/foo/file1.txt", "b=1", "b=2", required=True)
+	`,
+	error: `Content.replace: "b=1" not found in /foo/file1.txt`,
+}, {
+	summary: "Replace keeps the file permissions",
+	content: map[string]string{
+		"foo/file1.txt": "a=1\n",
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Chmod(filepath.Join(dir, "foo/file1.txt"), 0755), IsNil)
+	},
+	script: `
+		content.replace("/foo/file1.txt", "a=1", "a=2")
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0755 e7a76728", // "a=2\n"
+	},
+}, {
+	summary: "Replace rejects an empty old string",
+	content: map[string]string{
+		"foo/file1.txt": "a=1\n",
+	},
+	script: `
+		content.replace("/foo/file1.txt", "", "x")
+	`,
+	error: `Content.replace: empty old string`,
+}, {
+	summary: "Lstat entries",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("missing", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		lines = []
+		for path in ["/foo/file1.txt", "/foo/link"]:
+			st = content.lstat(path)
+			lines.append("%s %d %o %s %s %s %r\n" % (st.path, st.size, st.mode, st.is_dir, st.is_file, st.is_symlink, st.link_target))
+		st = content.lstat("/foo/")
+		lines.append("%s %o %s %s %s %r\n" % (st.path, st.mode, st.is_dir, st.is_file, st.is_symlink, st.link_target))
+		content.write("/out.txt", "".join(lines))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/link":      "symlink missing",
+		// "/foo/file1.txt 5 644 False True False \"\"\n" +
+		// "/foo/link 7 777 False False True \"missing\"\n" +
+		// "/foo 755 True False False \"\"\n"
+		"/out.txt": "file 0644 87c53129",
+	},
+}, {
+	summary: "Lstat validates symlink targets",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	hackdir: func(c *C, dir string) {
+		c.Assert(os.Symlink("../../bar", filepath.Join(dir, "foo/link")), IsNil)
+	},
+	script: `
+		content.lstat("/foo/link")
+	`,
+	error: `invalid content symlink: /foo/link`,
+}, {
+	summary: "Compare files",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+		"foo/file2.txt": `data1`,
+		"foo/file3.txt": `data2`,
+		"foo/file4.txt": `data`,
+	},
+	script: `
+		content.write("/foo/big1.txt", "x" * 100000 + "y")
+		content.write("/foo/big2.txt", "x" * 100000 + "y")
+		result = [
+			content.compare("/foo/file1.txt", "/foo/file2.txt"),
+			content.compare("/foo/file1.txt", "/foo/file3.txt"),
+			content.compare("/foo/file1.txt", "/foo/file4.txt"),
+			content.compare("/foo/big1.txt", "/foo/big2.txt"),
+		]
+		content.write("/foo/big1.txt", "")
+		content.write("/foo/big2.txt", "")
+		content.write("/out.txt", " ".join([str(r) for r in result]))
+	`,
+	result: map[string]string{
+		"/foo/":          "dir 0755",
+		"/foo/file1.txt": "file 0644 5b41362b",
+		"/foo/file2.txt": "file 0644 5b41362b",
+		"/foo/file3.txt": "file 0644 d98cf53e",
+		"/foo/file4.txt": "file 0644 3a6eb079",
+		"/foo/big1.txt":  "file 0644 empty",
+		"/foo/big2.txt":  "file 0644 empty",
+		"/out.txt":       "file 0644 ac595818", // "True False False True"
+	},
+}, {
+	summary: "Compare directories",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.compare("/foo/file1.txt", "/foo/")
+	`,
+	error: `read /foo/: is a directory`,
+}, {
+	summary: "Walk a tree pruning directories",
+	content: map[string]string{
+		"file1.txt":        `data1`,
+		"a/file2.txt":      `data1`,
+		"a/c/file3.txt":    `data1`,
+		"b/skip/file4.txt": `data1`,
+	},
+	script: `
+		lines = []
+		def visit(path, names):
+			lines.append("%s %s\n" % (path, names))
+			if path == "/":
+				return ["b"]
+		content.walk("/", visit)
+		content.write("/out.txt", "".join(lines))
+	`,
+	result: map[string]string{
+		"/file1.txt":        "file 0644 5b41362b",
+		"/a/":               "dir 0755",
+		"/a/file2.txt":      "file 0644 5b41362b",
+		"/a/c/":             "dir 0755",
+		"/a/c/file3.txt":    "file 0644 5b41362b",
+		"/b/":               "dir 0755",
+		"/b/skip/":          "dir 0755",
+		"/b/skip/file4.txt": "file 0644 5b41362b",
+		// "/ [\"a/\", \"b/\", \"file1.txt\"]\n" +
+		// "/a/ [\"c/\", \"file2.txt\"]\n" +
+		// "/a/c/ [\"file3.txt\"]\n"
+		"/out.txt": "file 0644 a2479966",
+	},
+}, {
+	summary: "Limit the depth of find and walk",
+	content: map[string]string{
+		"file1.txt":         `data1`,
+		"a/file2.txt":       `data1`,
+		"a/c/file3.txt":     `data1`,
+		"foo/file1.txt":     `data1`,
+		"foo/bar/file3.txt": `data1`,
+		"foo/bar/baz/x.txt": `data1`,
+	},
+	script: `
+		found = ",".join(content.find("/foo", lambda p: True, maxdepth=0))
+		found += "|" + ",".join(content.find("/foo/", lambda p: True, maxdepth=1))
+		content.write("/foo/out.txt", found)
+		paths = []
+		content.walk("/", lambda path, names: paths.append(path), maxdepth=1)
+		content.write("/out.txt", " ".join(paths))
+	`,
+	result: map[string]string{
+		"/file1.txt":         "file 0644 5b41362b",
+		"/a/":                "dir 0755",
+		"/a/file2.txt":       "file 0644 5b41362b",
+		"/a/c/":              "dir 0755",
+		"/a/c/file3.txt":     "file 0644 5b41362b",
+		"/foo/":              "dir 0755",
+		"/foo/file1.txt":     "file 0644 5b41362b",
+		"/foo/bar/":          "dir 0755",
+		"/foo/bar/file3.txt": "file 0644 5b41362b",
+		"/foo/bar/baz/":      "dir 0755",
+		"/foo/bar/baz/x.txt": "file 0644 5b41362b",
+		// "/foo/bar/,/foo/file1.txt|/foo/bar/,/foo/bar/baz/,/foo/bar/file3.txt,/foo/file1.txt"
+		"/foo/out.txt": "file 0644 e81d8cf4",
+		"/out.txt":     "file 0644 87676673", // "/ /a/ /foo/"
+	},
+}, {
+	summary: "Walk callbacks must return names",
+	content: map[string]string{
+		"a/file1.txt": `data1`,
+	},
+	script: `
+		content.walk("/", lambda path, names: 1)
+	`,
+	error: `Content.walk: callback must return a list of names or None, got int`,
+}, {
+	summary: "Forbid relative paths",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.read("foo/file1.txt")
+	`,
+	error: `content path must be absolute, got: foo/file1.txt`,
+}, {
+	summary: "Forbid leaving the content root",
+	content: map[string]string{
+		"foo/file1.txt": `data1`,
+	},
+	script: `
+		content.read("/foo/../../file1.txt")
+	`,
+	error: `invalid content path: /foo/../../file1.txt`,
+}, {
+	summary: "Forbid .. components even within the content root",
+	content: map[string]string{
+		"a/file1.txt": `data1`,
+		"b/file2.txt": `data2`,
+	},
+	script: `
+		content.read("/a/../b/file2.txt")
+	`,
+	checkr: func(p string) error {
+		if strings.Contains(p, "..") {
+			return fmt.Errorf("check got %s", p)
+		}
+		return nil
+	},
+	error: `invalid content path: /a/../b/file2.txt`,
+}, {
+	summary: "Forbid .. components in every method",
+	content: map[string]string{
+		"a/file1.txt": `data1`,
+	},
+	script: `
+		content.write("/a/../file1.txt", "data1")
+	`,
+	error: `invalid content path: /a/../file1.txt`,
+}, {
+	summary: "Names starting with dots are not .. components",
+	content: map[string]string{
+		"a/..file1.txt": `data1`,
+		"a/.../x.txt":   `data2`,
+	},
+	script: `
+		content.write("/a/out.txt", content.read("/a/..file1.txt") + content.read("/a/.../x.txt"))
+	`,
+	result: map[string]string{
+		"/a/":            "dir 0755",
+		"/a/..file1.txt": "file 0644 5b41362b",
+		"/a/.../":        "dir 0755",
+		"/a/.../x.txt":   "file 0644 d98cf53e",
+		"/a/out.txt":     "file 0644 53ddc036", // data1data2
+	},
+}, {
+	summary: "Forbid leaving the content via bad symlinks",
+	content: map[string]string{
+		"foo/file3.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		fpath1 := filepath.Join(dir, "foo/file1.txt")
+		fpath2 := filepath.Join(dir, "foo/file2.txt")
+		c.Assert(os.Symlink("file2.txt", fpath1), IsNil)
+		c.Assert(os.Symlink("../../bar", fpath2), IsNil)
+	},
+	script: `
+		content.read("/foo/file1.txt")
+	`,
+	error: `invalid content symlink: /foo/file2.txt`,
+}, {
+	summary: "Path errors refer to the root",
+	content: map[string]string{},
+	script: `
+		content.read("/foo/file1.txt")
+	`,
+	error: `open /foo/file1.txt: no such file or directory`,
+}, {
+	summary: "Check reads",
+	content: map[string]string{
+		"bar/file1.txt": `data1`,
+	},
+	script: `
+		content.write("/bar/file2.txt", "data2")
+		content.read("/bar/./file2.txt")
+	`,
+	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
+	error:  `no read: /bar/file2.txt`,
+}, {
+	summary: "Check writes",
+	content: map[string]string{
+		"bar/file1.txt": `data1`,
+	},
+	script: `
+		content.read("/bar/file1.txt")
+		content.write("/bar/./file1.txt", "data1")
+	`,
+	checkw: func(p string) error { return fmt.Errorf("no write: %s", p) },
+	error:  `no write: /bar/file1.txt`,
+}, {
+	summary: "Check lists",
+	content: map[string]string{
+		"bar/file1.txt": `data1`,
+	},
+	script: `
+		content.write("/bar/file2.txt", "data2")
+		content.list("/bar/./")
+	`,
+	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
+	error:  `no read: /bar/`,
+}, {
+	summary: "Check lists",
+	content: map[string]string{
+		"bar/file1.txt": `data1`,
+	},
+	script: `
+		content.write("/bar/file2.txt", "data2")
+		content.list("/bar/.")
+	`,
+	checkr: func(p string) error { return fmt.Errorf("no read: %s", p) },
+	error:  `no read: /bar/`,
+}, {
+	summary: "Check reads on symlinks",
+	content: map[string]string{
+		"foo/file2.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		fpath1 := filepath.Join(dir, "foo/file1.txt")
+		c.Assert(os.Symlink("file2.txt", fpath1), IsNil)
+	},
+	script: `
+		content.read("/foo/file1.txt")
+	`,
+	checkr: func(p string) error {
+		if p == "/foo/file2.txt" {
+			return fmt.Errorf("no read: %s", p)
+		}
+		return nil
+	},
+	error: `no read: /foo/file2.txt`,
+}, {
+	summary: "Check writes on symlinks",
+	content: map[string]string{
+		"foo/file2.txt": ``,
+	},
+	hackdir: func(c *C, dir string) {
+		fpath1 := filepath.Join(dir, "foo/file1.txt")
+		c.Assert(os.Symlink("file2.txt", fpath1), IsNil)
+	},
+	script: `
+		content.write("/foo/file1.txt", "")
+	`,
+	checkw: func(p string) error {
+		if p == "/foo/file2.txt" {
+			return fmt.Errorf("no write: %s", p)
+		}
+		return nil
+	},
+	error: `no write: /foo/file2.txt`,
+}}
+
+func (s *S) TestScripts(c *C) {
+	for _, test := range scriptsTests {
+		c.Logf("Summary: %s", test.summary)
+
+		rootDir := c.MkDir()
+		for path, data := range test.content {
+			fpath := filepath.Join(rootDir, path)
+			err := os.MkdirAll(filepath.Dir(fpath), 0755)
+			c.Assert(err, IsNil)
+			err = os.WriteFile(fpath, []byte(data), 0644)
+			c.Assert(err, IsNil)
+		}
+		if test.hackdir != nil {
+			test.hackdir(c, rootDir)
+		}
+
+		content := &scripts.ContentValue{
+			RootDir:    rootDir,
+			CheckRead:  test.checkr,
+			CheckWrite: test.checkw,
+		}
+		namespace := map[string]scripts.Value{
+			"content": content,
+		}
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: namespace,
+			Script:    string(testutil.Reindent(test.script)),
+		})
+		if test.error == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+
+		c.Assert(testutil.TreeDump(rootDir), DeepEquals, test.result)
+	}
+}
+
+func (s *S) TestContentRelative(c *C) {
+	content := scripts.ContentValue{RootDir: "foo"}
+	_, err := content.RealPath("/bar", scripts.CheckNone)
+	c.Assert(err, ErrorMatches, "internal error: content defined with relative root: foo")
+}
+
+func (s *S) TestRunContents(c *C) {
+	inputDir := c.MkDir()
+	outputDir := c.MkDir()
+	err := os.WriteFile(filepath.Join(inputDir, "file.txt"), []byte("data1"), 0644)
+	c.Assert(err, IsNil)
+
+	err = scripts.Run(&scripts.RunOptions{
+		Contents: map[string]*scripts.ContentValue{
+			"input":  {RootDir: inputDir},
+			"output": {RootDir: outputDir},
+		},
+		Script: `output.write("/file.txt", input.read("/file.txt"))`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(outputDir), DeepEquals, map[string]string{
+		"/file.txt": "file 0644 5b41362b",
+	})
+}
+
+func (s *S) TestRunContentsConflict(c *C) {
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{
+			"content": starlark.None,
+		},
+		Contents: map[string]*scripts.ContentValue{
+			"content": {RootDir: c.MkDir()},
+		},
+		Script: ``,
+	})
+	c.Assert(err, ErrorMatches, `content name "content" conflicts with namespace entry`)
+}
+
+func (s *S) TestRunContent(c *C) {
+	rootDir := c.MkDir()
+	content := &scripts.ContentValue{RootDir: rootDir}
+	err := scripts.Run(&scripts.RunOptions{
+		Content: content,
+		Script:  `content.write("/file.txt", "data1")`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file.txt": "file 0644 5b41362b",
+	})
+
+	for _, opts := range []*scripts.RunOptions{
+		{Namespace: map[string]scripts.Value{"content": starlark.None}},
+		{Contents: map[string]*scripts.ContentValue{"content": content}},
+		{Constants: map[string]string{"content": "data1"}},
+	} {
+		opts.Content = content
+		err = scripts.Run(opts)
+		c.Assert(err, ErrorMatches, `cannot provide Content with another entry named "content"`)
+	}
+}
+
+func (s *S) TestRunOutput(c *C) {
+	var stdout, stderr bytes.Buffer
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"output": scripts.OutputBuiltin},
+		Script: string(testutil.Reindent(`
+			output(stdout="out1 ")
+			output(stderr="err1 ")
+			output(stdout="out2", stderr="err2")
+		`)),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(stdout.String(), Equals, "out1 out2")
+	c.Assert(stderr.String(), Equals, "err1 err2")
+
+	// Output is discarded by default.
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"output": scripts.OutputBuiltin},
+		Script:    `output(stdout="out", stderr="err")`,
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestRunConstants(c *C) {
+	rootDir := c.MkDir()
+	err := scripts.Run(&scripts.RunOptions{
+		Contents: map[string]*scripts.ContentValue{
+			"content": {RootDir: rootDir},
+		},
+		Constants: map[string]string{
+			"arch":    "data1",
+			"release": "data2",
+		},
+		Script: `content.write("/file.txt", arch + release)`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file.txt": "file 0644 53ddc036", // data1data2
+	})
+
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"arch": starlark.None},
+		Constants: map[string]string{"arch": "amd64"},
+	})
+	c.Assert(err, ErrorMatches, `constant name "arch" conflicts with namespace entry`)
+	err = scripts.Run(&scripts.RunOptions{
+		Contents:  map[string]*scripts.ContentValue{"arch": {RootDir: rootDir}},
+		Constants: map[string]string{"arch": "amd64"},
+	})
+	c.Assert(err, ErrorMatches, `constant name "arch" conflicts with namespace entry`)
+	err = scripts.Run(&scripts.RunOptions{
+		Constants: map[string]string{"my-arch": "amd64"},
+	})
+	c.Assert(err, ErrorMatches, `invalid namespace entry "my-arch": not a valid identifier`)
+}
+
+func (s *S) TestContentNamespace(c *C) {
+	rootDir := c.MkDir()
+	namespace, err := scripts.ContentNamespace("root", &scripts.ContentValue{RootDir: rootDir})
+	c.Assert(err, IsNil)
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: namespace,
+		Script:    `root.write("/file.txt", "data1")`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file.txt": "file 0644 5b41362b",
+	})
+
+	for _, name := range []string{"", "1content", "my-content", "if", " content"} {
+		_, err = scripts.ContentNamespace(name, &scripts.ContentValue{RootDir: rootDir})
+		c.Assert(err, ErrorMatches, fmt.Sprintf("invalid namespace entry %q: not a valid identifier", name))
+	}
+	_, err = scripts.ContentNamespace("content", nil)
+	c.Assert(err, ErrorMatches, `invalid namespace entry "content": value is nil`)
+}
+
+func (s *S) TestNamespaceError(c *C) {
+	tests := []struct {
+		options *scripts.RunOptions
+		error   string
+	}{{
+		options: &scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"my-value": starlark.None},
+		},
+		error: `invalid namespace entry "my-value": not a valid identifier`,
+	}, {
+		options: &scripts.RunOptions{
+			Contents: map[string]*scripts.ContentValue{"my-content": {RootDir: c.MkDir()}},
+		},
+		error: `invalid namespace entry "my-content": not a valid identifier`,
+	}, {
+		options: &scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"b": nil, "a": starlark.None, "c-": nil},
+		},
+		error: `invalid namespace entry "b": value is nil`,
+	}, {
+		options: &scripts.RunOptions{
+			Contents: map[string]*scripts.ContentValue{"content": nil},
+		},
+		error: `invalid namespace entry "content": value is nil`,
+	}}
+	for _, test := range tests {
+		err := scripts.Run(test.options)
+		c.Assert(err, ErrorMatches, test.error)
+		var nerr *scripts.NamespaceError
+		c.Assert(errors.As(err, &nerr), Equals, true)
+	}
+}
+
+func (s *S) TestPermissionError(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file.txt"), []byte("data1"), 0644), IsNil)
+	content := &scripts.ContentValue{
+		RootDir:    rootDir,
+		CheckWrite: scripts.DenyGlobs("/file.txt"),
+	}
+	run := func(script string) error {
+		return scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    script,
+		})
+	}
+
+	err := run(`content.write("/file.txt", "data2")`)
+	c.Assert(err, ErrorMatches, "permission denied: /file.txt")
+	var perr *scripts.PermissionError
+	c.Assert(errors.As(err, &perr), Equals, true)
+	c.Assert(perr.Path, Equals, "/file.txt")
+	c.Assert(errors.Is(err, fs.ErrPermission), Equals, true)
+
+	err = run(`content.read("/missing.txt")`)
+	c.Assert(err, ErrorMatches, "open /missing.txt: no such file or directory")
+	c.Assert(errors.As(err, &perr), Equals, false)
+}
+
+func (s *S) TestWriteError(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file.txt"), []byte("data1"), 0644), IsNil)
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{
+			"content": &scripts.ContentValue{RootDir: rootDir},
+		},
+		Script: `content.write("/file.txt/sub.txt", "data2")`,
+	})
+	c.Assert(err, ErrorMatches, "open /file.txt/sub.txt: not a directory")
+	var werr *scripts.WriteError
+	c.Assert(errors.As(err, &werr), Equals, true)
+	c.Assert(werr.Path, Equals, "/file.txt/sub.txt")
+	c.Assert(werr.IsNoSpace(), Equals, false)
+	c.Assert(errors.Is(err, syscall.ENOTDIR), Equals, true)
+
+	werr = &scripts.WriteError{
+		Path: "/file.txt",
+		Err:  &os.PathError{Op: "write", Path: "/file.txt", Err: syscall.ENOSPC},
+	}
+	c.Assert(werr.IsNoSpace(), Equals, true)
+	c.Assert(werr, ErrorMatches, "write /file.txt: no space left on device")
+}
+
+func (s *S) TestVerboseErrors(c *C) {
+	rootDir := c.MkDir()
+	content := &scripts.ContentValue{RootDir: rootDir, VerboseErrors: true}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.read("/missing.txt")`,
+	})
+	c.Assert(err, ErrorMatches, "open /missing.txt: no such file or directory")
+	var perr *scripts.ContentPathError
+	c.Assert(errors.As(err, &perr), Equals, true)
+	c.Assert(perr.Path, Equals, "/missing.txt")
+	c.Assert(perr.Err.Path, Equals, filepath.Join(rootDir, "missing.txt"))
+	c.Assert(errors.Is(err, fs.ErrNotExist), Equals, true)
+
+	// Errors are still wrapped as usual.
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file.txt"), []byte("data1"), 0644), IsNil)
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.write("/file.txt/sub.txt", "data2")`,
+	})
+	c.Assert(err, ErrorMatches, "open /file.txt/sub.txt: not a directory")
+	var werr *scripts.WriteError
+	c.Assert(errors.As(err, &werr), Equals, true)
+	c.Assert(errors.As(err, &perr), Equals, true)
+	c.Assert(perr.Err.Path, Equals, filepath.Join(rootDir, "file.txt/sub.txt"))
+
+	// Content.read with a default still detects missing files.
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.write("/out.txt", content.read("/missing.txt", default="data2"))`,
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestWriteEntry(c *C) {
+	rootDir := c.MkDir()
+	var entries []fsutil.Entry
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			entries = append(entries, *entry)
+			return nil
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			entry = content.write("/./foo.txt", "data1")
+			info = "%s %o %d %r %s" % (entry.path, entry.mode, entry.size, entry.link, entry.hash[:8])
+			content.write("/entry.txt", info)
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/foo.txt":   "file 0644 5b41362b",
+		"/entry.txt": "file 0644 5aaeeb46", // "/foo.txt 644 5 \"\" 5b41362b"
+	})
+	c.Assert(entries, DeepEquals, []fsutil.Entry{{
+		Path: "/foo.txt",
+		Mode: 0644,
+		Hash: "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9",
+		Size: 5,
+	}, {
+		Path: "/entry.txt",
+		Mode: 0644,
+		Hash: "5aaeeb466e446bb5922929e869fb839c66239d539758bbdd6c23e7c16bd44245",
+		Size: 26,
+	}})
+}
+
+func (s *S) TestWriteEntryError(c *C) {
+	content := &scripts.ContentValue{
+		RootDir: c.MkDir(),
+		OnWrite: func(entry *fsutil.Entry) error {
+			return fmt.Errorf("cannot record %s", entry.Path)
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.write("/foo.txt", "data1")`,
+	})
+	c.Assert(err, ErrorMatches, "cannot record /foo.txt")
+}
+
+func (s *S) TestSubOnWrite(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "foo"), 0755), IsNil)
+	var paths []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			paths = append(paths, entry.Path)
+			return nil
+		},
+	}
+	sub, err := content.Sub("/foo/")
+	c.Assert(err, IsNil)
+	c.Assert(sub.RootDir, Equals, filepath.Join(rootDir, "foo"))
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": sub},
+		Script:    `content.write("/file1.txt", "data1")`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{"/foo/file1.txt"})
+}
+
+func (s *S) TestConcurrentWrites(c *C) {
+	rootDir := c.MkDir()
+	var paths []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			// Not synchronized on purpose.
+			paths = append(paths, entry.Path)
+			return nil
+		},
+	}
+	const count = 8
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			errs <- scripts.Run(&scripts.RunOptions{
+				Namespace: map[string]scripts.Value{"content": content},
+				Script:    fmt.Sprintf(`content.write("/file%d.txt", "data")`, i),
+			})
+		}(i)
+	}
+	for i := 0; i < count; i++ {
+		c.Assert(<-errs, IsNil)
+	}
+	sort.Strings(paths)
+	c.Assert(paths, HasLen, count)
+	c.Assert(paths[0], Equals, "/file0.txt")
+	c.Assert(paths[count-1], Equals, fmt.Sprintf("/file%d.txt", count-1))
+}
+
+func (s *S) TestRunScriptReader(c *C) {
+	rootDir := c.MkDir()
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{
+			"content": &scripts.ContentValue{RootDir: rootDir},
+		},
+		ScriptReader: strings.NewReader(`content.write("/file.txt", "data1")`),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file.txt": "file 0644 5b41362b",
+	})
+
+	err = scripts.Run(&scripts.RunOptions{
+		Script:       `x = 1`,
+		ScriptReader: strings.NewReader(`x = 2`),
+	})
+	c.Assert(err, ErrorMatches, "cannot provide both Script and ScriptReader")
+}
+
+func (s *S) TestStrictGlobals(c *C) {
+	content := &scripts.ContentValue{RootDir: c.MkDir()}
+	tests := []struct {
+		script string
+		error  string
+	}{{
+		script: "x = 1\ndef f():\n    x = 2\n    return [x for x in [x]]\ny = f()",
+	}, {
+		script: "x = 1\nx = 2",
+		error:  `strict:2:1: cannot reassign global x declared at strict:1:1`,
+	}, {
+		script: "x = 1\nx += 1",
+		error:  `strict:2:1: cannot reassign global x declared at strict:1:1`,
+	}, {
+		script: "def f():\n    pass\n(a, [b, f]) = (1, [2, 3])",
+		error:  `strict:3:9: cannot reassign global f declared at strict:1:5`,
+	}, {
+		script: "content = None",
+		error:  `strict:1:1: cannot reassign predeclared content`,
+	}}
+	for _, test := range tests {
+		c.Logf("Script: %q", test.script)
+		opts := &scripts.RunOptions{
+			Label:     "strict",
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    test.script,
+		}
+		err := scripts.Run(opts)
+		c.Assert(err, IsNil)
+		opts.StrictGlobals = true
+		err = scripts.Run(opts)
+		if test.error == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, test.error)
+		}
+	}
+}
+
+func (s *S) TestAllowRecursion(c *C) {
+	recursive := `
+def fact(n):
+    return 1 if n <= 1 else n * fact(n - 1)
+result = fact(5)
+`
+	err := scripts.Run(&scripts.RunOptions{Script: recursive})
+	c.Assert(err, ErrorMatches, "function fact called recursively")
+	err = scripts.Run(&scripts.RunOptions{Script: recursive, AllowRecursion: true})
+	c.Assert(err, IsNil)
+
+	loop := `
+def count():
+    n = 0
+    while n < 3:
+        n += 1
+    return n
+result = count()
+`
+	err = scripts.Run(&scripts.RunOptions{Label: "loop", Script: loop})
+	c.Assert(err, ErrorMatches, `loop:4:5: dialect does not support while loops`)
+	err = scripts.Run(&scripts.RunOptions{Label: "loop", Script: loop, AllowRecursion: true})
+	c.Assert(err, IsNil)
+
+	program, err := scripts.Compile("program", recursive)
+	c.Assert(err, IsNil)
+	c.Assert(program.Run(&scripts.RunOptions{}), ErrorMatches, "function fact called recursively")
+	c.Assert(program.Run(&scripts.RunOptions{AllowRecursion: true}), IsNil)
+}
+
+var programTests = []struct {
+	summary string
+	script  string
+	strict  bool
+	error   string
+}{{
+	summary: "Script using the content",
+	script: `
+		data = content.read("/file.txt")
+		content.write("/out.txt", data + data)
+	`,
+}, {
+	summary: "Globals reassigned with StrictGlobals",
+	script: `
+		data = content.read("/file.txt")
+		data = data + data
+	`,
+	strict: true,
+	error:  `program:2:1: cannot reassign global data declared at program:1:1`,
+}, {
+	summary: "Predeclared names reassigned with StrictGlobals",
+	script: `
+		content = None
+	`,
+	strict: true,
+	error:  `program:1:1: cannot reassign predeclared content`,
+}, {
+	summary: "While loops without AllowRecursion",
+	script: `
+		def f():
+			while True:
+				content.write("/out.txt", "data")
+		f()
+	`,
+	error: `program:2:5: dialect does not support while loops`,
+}, {
+	summary: "Undefined names",
+	script: `
+		content.write("/out.txt", missing)
+	`,
+	error: `program:1:27: undefined: missing`,
+}}
+
+func (s *S) TestProgramRunMatchesRun(c *C) {
+	for _, test := range programTests {
+		c.Logf("Summary: %s", test.summary)
+		script := string(testutil.Reindent(test.script))
+		program, err := scripts.Compile("program", script)
+		c.Assert(err, IsNil)
+		for _, data := range []string{"data1", "data2"} {
+			var dumps []map[string]string
+			var errs []error
+			for _, useProgram := range []bool{false, true} {
+				rootDir := c.MkDir()
+				c.Assert(os.WriteFile(filepath.Join(rootDir, "file.txt"), []byte(data), 0644), IsNil)
+				opts := &scripts.RunOptions{
+					Label:         "program",
+					Script:        script,
+					Content:       &scripts.ContentValue{RootDir: rootDir},
+					StrictGlobals: test.strict,
+				}
+				if useProgram {
+					err = program.Run(opts)
+				} else {
+					err = scripts.Run(opts)
+				}
+				dumps = append(dumps, testutil.TreeDump(rootDir))
+				errs = append(errs, err)
+			}
+			if test.error == "" {
+				c.Assert(errs[0], IsNil)
+			} else {
+				c.Assert(errs[0], ErrorMatches, test.error)
+			}
+			c.Assert(errs[1], DeepEquals, errs[0])
+			c.Assert(dumps[1], DeepEquals, dumps[0])
+		}
+	}
+}
+
+func (s *S) TestRunConcurrency(c *C) {
+	// Each run waits inside the script for the other one to get there
+	// as well, which only happens if they execute at the same time.
+	const count = 2
+	var arrived sync.WaitGroup
+	arrived.Add(count)
+	all := make(chan bool)
+	go func() {
+		arrived.Wait()
+		close(all)
+	}()
+	wait := starlark.NewBuiltin("wait", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (scripts.Value, error) {
+		arrived.Done()
+		select {
+		case <-all:
+			return starlark.None, nil
+		case <-time.After(5 * time.Second):
+			return nil, fmt.Errorf("runs did not execute at the same time")
+		}
+	})
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			errs <- scripts.Run(&scripts.RunOptions{
+				Namespace: map[string]scripts.Value{"wait": wait},
+				Script:    "wait()",
+			})
+		}()
+	}
+	for i := 0; i < count; i++ {
+		c.Assert(<-errs, IsNil)
+	}
+}
+
+func (s *S) TestAllowRecursionConcurrency(c *C) {
+	recursive := `
+def fact(n):
+    if n <= 1:
+        block()
+        return 1
+    return n * fact(n - 1)
+result = fact(5)
+`
+	started := make(chan bool, 1)
+	release := make(chan bool)
+	block := starlark.NewBuiltin("block", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (scripts.Value, error) {
+		select {
+		case started <- true:
+		default:
+		}
+		<-release
+		return starlark.None, nil
+	})
+	namespace := map[string]scripts.Value{"block": block}
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- scripts.Run(&scripts.RunOptions{Namespace: namespace, Script: recursive, AllowRecursion: true})
+	}()
+	<-started
+
+	// Compiling and runs that allow recursion as well proceed while the
+	// first run is still going.
+	finished := make(chan error, 1)
+	go func() {
+		_, err := scripts.Compile("program", "result = 1")
+		if err == nil {
+			err = scripts.Run(&scripts.RunOptions{Script: "result = 1", AllowRecursion: true})
+		}
+		finished <- err
+	}()
+	select {
+	case err := <-finished:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		close(release)
+		c.Fatalf("compiling blocked by a running script")
+	}
+
+	// Runs that disallow recursion wait for it to finish, so they never
+	// observe its setting.
+	disallowed := make(chan error, 1)
+	go func() {
+		disallowed <- scripts.Run(&scripts.RunOptions{Namespace: namespace, Script: recursive})
+	}()
+	select {
+	case err := <-disallowed:
+		close(release)
+		c.Fatalf("run disallowing recursion did not wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	c.Assert(<-blocked, IsNil)
+	c.Assert(<-disallowed, ErrorMatches, "function fact called recursively")
+}
+
+func (s *S) TestTransform(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "foo"), 0755), IsNil)
+
+	var paths []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		Transform: func(path string, data []byte) ([]byte, error) {
+			paths = append(paths, path)
+			if strings.HasSuffix(path, ".bad") {
+				return nil, fmt.Errorf("refusing file")
+			}
+			return bytes.ReplaceAll(data, []byte("-"), nil), nil
+		},
+	}
+	c.Assert(content.AttrNames(), Not(testutil.Contains), "open_write")
+	c.Assert(content.AttrNames(), Not(testutil.Contains), "append_line")
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			entry = content.write("/file1.txt", "da-ta-1")
+			if entry.size != 5:
+				fail("unexpected size: %d", entry.size)
+			content.sub("/foo").write("/file2.txt", "-data2-")
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []string{"/file1.txt", "/foo/file2.txt"})
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt":     "file 0644 5b41362b",
+		"/foo/":          "dir 0755",
+		"/foo/file2.txt": "file 0644 d98cf53e",
+	})
+
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.write("/file.bad", "data3")`,
+	})
+	c.Assert(err, ErrorMatches, "cannot transform /file.bad: refusing file")
+	_, err = os.Lstat(filepath.Join(rootDir, "file.bad"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *S) TestHelp(c *C) {
+	content := &scripts.ContentValue{RootDir: c.MkDir()}
+	result, err := evalExpr(map[string]scripts.Value{"content": content}, `content.help()`)
+	c.Assert(err, IsNil)
+	help, err := strconv.Unquote(result)
+	c.Assert(err, IsNil)
+	c.Assert(help, testutil.Contains, "read(path, default?)\n")
+	c.Assert(help, testutil.Contains, "help()\n")
+	c.Assert(help, Not(testutil.Contains), "move_into(")
+
+	// Every method is documented.
+	var names []string
+	for _, line := range strings.Split(strings.TrimSuffix(help, "\n"), "\n") {
+		name, params, ok := strings.Cut(line, "(")
+		c.Assert(ok && params != "...)", Equals, true, Commentf("%s", line))
+		names = append(names, name)
+	}
+	c.Assert(names, DeepEquals, content.AttrNames())
+}
+
+func (s *S) TestMaxWriteSize(c *C) {
+	hostDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(hostDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(hostDir, "file2.txt"), []byte("data2+"), 0644), IsNil)
+
+	rootDir := c.MkDir()
+	content := &scripts.ContentValue{
+		RootDir:      rootDir,
+		MaxWriteSize: 5,
+		AllowImport:  func(hostPath string) error { return nil },
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(fmt.Sprintf(`
+			content.write("/file1.txt", "data1")
+			content.move_into(%q, "/file2.txt")
+			w = content.open_write("/file3.txt")
+			w.write("data")
+			w.write("3")
+			w.close()
+		`, filepath.Join(hostDir, "file1.txt")))),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+		"/file2.txt": "file 0644 5b41362b",
+		"/file3.txt": "file 0644 f60f2d65",
+	})
+
+	for _, script := range []string{
+		`content.write("/file4.txt", "data1+")`,
+		fmt.Sprintf(`content.move_into(%q, "/file4.txt")`, filepath.Join(hostDir, "file2.txt")),
+		`content.open_write("/file4.txt").write("data1+")`,
+		`content.append_line("/file4.txt", "data1")`,
+	} {
+		err = scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    script,
+		})
+		c.Assert(err, ErrorMatches, "write exceeds maximum size of 5 bytes: /file4.txt")
+	}
+	// Only the writer created the file before its data was rejected.
+	c.Assert(testutil.TreeDump(rootDir)["/file4.txt"], Equals, "file 0644 empty")
+}
+
+func (s *S) TestOpenWrite(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file3.txt"), []byte("data3"), 0644), IsNil)
+
+	var entries []fsutil.Entry
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			entries = append(entries, *entry)
+			return nil
+		},
+	}
+	run := func(script string) error {
+		return scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    string(testutil.Reindent(script)),
+		})
+	}
+
+	err := run(`
+		w = content.open_write("/file1.txt")
+		w.write("da")
+		w.write(b"ta1")
+		entry = w.close()
+		if entry.size != 5:
+			fail("unexpected size: %d" % entry.size)
+		w = content.open_write("/file2.txt", atomic=True)
+		w.write("data2")
+		w.close()
+		content.open_write("/file3.txt", atomic=True).write("discarded")
+		content.open_write("/file4.txt").write("partial")
+	`)
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+		"/file2.txt": "file 0644 d98cf53e",
+		"/file3.txt": "file 0644 f60f2d65", // "data3"
+		"/file4.txt": "file 0644 9834a14a", // "partial"
+	})
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	c.Assert(paths, DeepEquals, []string{"/file1.txt", "/file2.txt", "/file4.txt"})
+	c.Assert(entries[0].Hash, Equals, "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9")
+	c.Assert(entries[0].Size, Equals, 5)
+
+	err = run(`
+		w = content.open_write("/file1.txt")
+		w.close()
+		w.write("data")
+	`)
+	c.Assert(err, ErrorMatches, "FileWriter.write: writer is closed")
+	err = run(`
+		w = content.open_write("/file1.txt")
+		w.close()
+		w.close()
+	`)
+	c.Assert(err, ErrorMatches, "FileWriter.close: writer is closed")
+	err = run(`content.open_write("/missing/file.txt")`)
+	c.Assert(err, ErrorMatches, "open /missing/file.txt: no such file or directory")
+}
+
+func (s *S) TestDryRun(c *C) {
+	rootDir := c.MkDir()
+	err := os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644)
+	c.Assert(err, IsNil)
+
+	var entries []fsutil.Entry
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		DryRun:  true,
+		OnWrite: func(entry *fsutil.Entry) error {
+			entries = append(entries, *entry)
+			return nil
+		},
+	}
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			content.write("/file1.txt", "")
+			content.write("/file2.txt", content.read("/file1.txt"))
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+	})
+	c.Assert(entries, DeepEquals, []fsutil.Entry{{
+		Path: "/file1.txt",
+		Mode: 0644,
+		Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}, {
+		Path: "/file2.txt",
+		Mode: 0644,
+		Hash: "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9",
+		Size: 5,
+	}})
+
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.write("/file1.txt", "", exclusive=True)`,
+	})
+	c.Assert(err, ErrorMatches, "open /file1.txt: file exists")
+}
+
+func (s *S) TestMakeTemp(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "foo"), 0755), IsNil)
+	var paths []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			paths = append(paths, entry.Path)
+			return nil
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			d = content.mkdtemp("/foo", prefix="work")
+			f = content.mktemp(d)
+			content.write("/result.txt", d + "\n" + f)
+		`)),
+	})
+	c.Assert(err, IsNil)
+	data, err := os.ReadFile(filepath.Join(rootDir, "result.txt"))
+	c.Assert(err, IsNil)
+	result := strings.Split(string(data), "\n")
+	c.Assert(result, HasLen, 2)
+	c.Assert(result[0], Matches, `/foo/work[0-9]+/`)
+	c.Assert(result[1], Matches, result[0]+`tmp[0-9]+`)
+	c.Assert(paths, DeepEquals, []string{result[0], result[1], "/result.txt"})
+
+	dump := testutil.TreeDump(rootDir)
+	c.Assert(dump[result[0]], Equals, "dir 0700")
+	c.Assert(dump[result[1]], Equals, "file 0600 empty")
+}
+
+func (s *S) TestWithTempDir(c *C) {
+	rootDir := c.MkDir()
+	var written, removed []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			written = append(written, entry.Path)
+			return nil
+		},
+		OnRemove: func(path string) error {
+			removed = append(removed, path)
+			return nil
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			def work(d):
+				content.mkdir(d + "sub")
+				content.write(d + "sub/file1.txt", "data1")
+				content.write(d + "file2.txt", "data2")
+				return d
+			d = content.with_tempdir(work, prefix="work")
+			content.write("/result.txt", d)
+		`)),
+	})
+	c.Assert(err, IsNil)
+	data, err := os.ReadFile(filepath.Join(rootDir, "result.txt"))
+	c.Assert(err, IsNil)
+	d := string(data)
+	c.Assert(d, Matches, `/work[0-9]+/`)
+	c.Assert(written, DeepEquals, []string{d, d + "sub/", d + "sub/file1.txt", d + "file2.txt", "/result.txt"})
+	c.Assert(removed, DeepEquals, []string{d + "sub/file1.txt", d + "sub/", d + "file2.txt", d})
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/result.txt": "file 0644 " + fmt.Sprintf("%x", sha256.Sum256(data))[:8],
+	})
+
+	// The directory is removed when the callback fails as well.
+	removed = nil
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			def work(d):
+				content.write(d + "file1.txt", "data1")
+				fail("oops")
+			content.with_tempdir(work, dir="/")
+		`)),
+	})
+	c.Assert(err, ErrorMatches, "oops")
+	c.Assert(removed, HasLen, 2)
+	c.Assert(testutil.TreeDump(rootDir), HasLen, 1)
+}
+
+func (s *S) TestMakeTempErrors(c *C) {
+	content := &scripts.ContentValue{
+		RootDir:    c.MkDir(),
+		CheckWrite: scripts.DenyGlobs("/**"),
+	}
+	tests := map[string]string{
+		`content.mktemp(prefix="a/b")`:  `Content.mktemp: prefix cannot contain slashes: a/b`,
+		`content.mkdtemp("foo")`:        `content path must be absolute, got: foo`,
+		`content.mktemp("/", "prefix")`: `permission denied: /prefix[0-9]+`,
+	}
+	for script, error := range tests {
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    script,
+		})
+		c.Assert(err, ErrorMatches, error)
+	}
+}
+
+func (s *S) TestOpTimeout(c *C) {
+	rootDir := c.MkDir()
+	fifo := filepath.Join(rootDir, "fifo")
+	c.Assert(syscall.Mkfifo(fifo, 0644), IsNil)
+
+	// Keep a writer around so reads block instead of seeing EOF.
+	opened := make(chan *os.File, 1)
+	go func() {
+		file, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		c.Check(err, IsNil)
+		opened <- file
+	}()
+	defer func() {
+		if file := <-opened; file != nil {
+			file.Close()
 		}
-		namespace := map[string]scripts.Value{
-			"content": content,
+	}()
+
+	content := &scripts.ContentValue{
+		RootDir:   rootDir,
+		OpTimeout: 50 * time.Millisecond,
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.read("/fifo")`,
+	})
+	c.Assert(err, ErrorMatches, `read /fifo: i/o timeout`)
+	c.Assert(errors.Is(err, os.ErrDeadlineExceeded), Equals, true)
+}
+
+func (s *S) TestOpTimeoutAfterFirstLine(c *C) {
+	for _, script := range []string{
+		`content.read_lines("/fifo")`,
+		`content.grep("/fifo", "line")`,
+	} {
+		c.Logf("Script: %s", script)
+		rootDir := c.MkDir()
+		fifo := filepath.Join(rootDir, "fifo")
+		c.Assert(syscall.Mkfifo(fifo, 0644), IsNil)
+
+		// Write the first line right away, and only finish well after
+		// the timeout, so that later reads must be interrupted.
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			file, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+			if !c.Check(err, IsNil) {
+				return
+			}
+			defer file.Close()
+			_, err = file.Write([]byte("line1\n"))
+			c.Check(err, IsNil)
+			time.Sleep(500 * time.Millisecond)
+			file.Write([]byte("line2\n"))
+		}()
+
+		content := &scripts.ContentValue{
+			RootDir:   rootDir,
+			OpTimeout: 50 * time.Millisecond,
 		}
 		err := scripts.Run(&scripts.RunOptions{
-			Namespace: namespace,
-			Script:    string(testutil.Reindent(test.script)),
+			Content: content,
+			Script:  script,
 		})
-		if test.error == "" {
-			c.Assert(err, IsNil)
+		c.Assert(err, ErrorMatches, `read /fifo: i/o timeout`)
+		c.Assert(errors.Is(err, os.ErrDeadlineExceeded), Equals, true)
+		<-finished
+	}
+}
+
+func (s *S) TestAudit(c *C) {
+	rootDir := c.MkDir()
+	err := os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644)
+	c.Assert(err, IsNil)
+
+	hostDir := c.MkDir()
+	err = os.WriteFile(filepath.Join(hostDir, "file5.txt"), []byte("data5"), 0644)
+	c.Assert(err, IsNil)
+
+	var records []string
+	content := &scripts.ContentValue{
+		RootDir:     rootDir,
+		CheckWrite:  scripts.DenyGlobs("/file1.txt"),
+		AllowImport: func(hostPath string) error { return nil },
+		Audit: func(op string, path string, err error) {
+			records = append(records, fmt.Sprintf("%s %s %v", op, path, err))
+		},
+	}
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(fmt.Sprintf(`
+			content.list("/")
+			content.write(path="/file2.txt", data=content.read("/file1.txt"))
+			content.hardlink("/file2.txt", "/file3.txt")
+			content.move("/file3.txt", dst="/file4.txt")
+			content.move_into(%q, "/file5.txt")
+			def noop(dir):
+				pass
+			content.with_tempdir(noop)
+			content.write("/file1.txt", "data2")
+		`, filepath.Join(hostDir, "file5.txt")))),
+	})
+	c.Assert(err, ErrorMatches, "permission denied: /file1.txt")
+	c.Assert(records, DeepEquals, []string{
+		"list / <nil>",
+		"read /file1.txt <nil>",
+		"write /file2.txt <nil>",
+		"hardlink /file3.txt <nil>",
+		"move /file4.txt <nil>",
+		"move_into /file5.txt <nil>",
+		"with_tempdir / <nil>",
+		"write /file1.txt permission denied: /file1.txt",
+	})
+}
+
+func (s *S) TestTouch(c *C) {
+	rootDir := c.MkDir()
+	fpath1 := filepath.Join(rootDir, "file1.txt")
+	c.Assert(os.WriteFile(fpath1, []byte("data1"), 0644), IsNil)
+	old := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(fpath1, old, old), IsNil)
+
+	var paths []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			paths = append(paths, entry.Path)
+			return nil
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			content.touch("/file1.txt")
+			content.touch("/file2.txt", mtime=1000000000)
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+		"/file2.txt": "file 0644 empty",
+	})
+	c.Assert(paths, DeepEquals, []string{"/file2.txt"})
+
+	info, err := os.Stat(fpath1)
+	c.Assert(err, IsNil)
+	c.Assert(info.ModTime().After(old.Add(time.Minute)), Equals, true)
+	info, err = os.Stat(filepath.Join(rootDir, "file2.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(info.ModTime().Unix(), Equals, int64(1000000000))
+}
+
+func (s *S) TestSetTimes(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(rootDir, "dir/sub"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "dir/sub/file1.txt"), []byte("data1"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file2.txt"), []byte("data2"), 0644), IsNil)
+	c.Assert(os.Symlink("../file2.txt", filepath.Join(rootDir, "dir/link")), IsNil)
+
+	var entries []fsutil.Entry
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			entries = append(entries, *entry)
+			return nil
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			content.set_times("/file2.txt", 1000000000, atime=1000000001)
+			content.set_times("/dir", 1200000000, recursive=True)
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(entries, DeepEquals, []fsutil.Entry{{
+		Path: "/file2.txt",
+		Mode: 0644,
+		Hash: "d98cf53e0c8b77c14a96358d5b69584225b4bb9026423cbc2f7b0161894c402c",
+		Size: 5,
+	}, {
+		Path: "/dir/",
+		Mode: fs.ModeDir | 0755,
+	}, {
+		Path: "/dir/sub/",
+		Mode: fs.ModeDir | 0755,
+	}, {
+		Path: "/dir/sub/file1.txt",
+		Mode: 0644,
+		Hash: "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9",
+		Size: 5,
+	}})
+
+	for path, mtime := range map[string]int64{
+		"file2.txt":         1000000000,
+		"dir":               1200000000,
+		"dir/sub":           1200000000,
+		"dir/sub/file1.txt": 1200000000,
+	} {
+		info, err := os.Stat(filepath.Join(rootDir, path))
+		c.Assert(err, IsNil)
+		c.Assert(info.ModTime().Unix(), Equals, mtime, Commentf("%s", path))
+	}
+
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.set_times("/missing", 1000000000)`,
+	})
+	c.Assert(err, ErrorMatches, "chtimes /missing: no such file or directory")
+}
+
+func (s *S) TestChecksumTree(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(rootDir, "foo/bar"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "foo/file1.txt"), []byte("data1"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "foo/bar/file2.txt"), []byte("data2"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file3.txt"), []byte("data3"), 0644), IsNil)
+	c.Assert(os.Symlink("../file3.txt", filepath.Join(rootDir, "foo/link")), IsNil)
+	namespace := map[string]scripts.Value{"content": &scripts.ContentValue{RootDir: rootDir}}
+
+	result, err := evalExpr(namespace, `content.checksum_tree("/foo")`)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, fmt.Sprintf(`{"/foo/bar/file2.txt": "%x", "/foo/file1.txt": "%x", "/foo/link": "%x"}`,
+		sha256.Sum256([]byte("data2")), sha256.Sum256([]byte("data1")), sha256.Sum256([]byte("../file3.txt"))))
+
+	result, err = evalExpr(namespace, `content.checksum_tree("/foo/bar", algo="sha512")`)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, fmt.Sprintf(`{"/foo/bar/file2.txt": "%x"}`, sha512.Sum512([]byte("data2"))))
+
+	_, err = evalExpr(namespace, `content.checksum_tree("/foo", algo="md5")`)
+	c.Assert(err, ErrorMatches, `Content.checksum_tree: unsupported algorithm: "md5"`)
+}
+
+func (s *S) TestRealPathDotDot(c *C) {
+	rootDir := c.MkDir()
+	var checked []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		CheckRead: func(path string) error {
+			checked = append(checked, path)
+			return nil
+		},
+	}
+	for _, path := range []string{"/a/../b", "/../etc", "/a/b/../../../etc", "/a/..", "/.."} {
+		_, err := content.RealPath(path, scripts.CheckRead)
+		c.Assert(err, ErrorMatches, "invalid content path: "+regexp.QuoteMeta(path))
+	}
+	c.Assert(checked, HasLen, 0)
+
+	for _, path := range []string{"/", "/a/b", "/a/./b/", "/a/..b", "/.../b"} {
+		fpath, err := content.RealPath(path, scripts.CheckRead)
+		c.Assert(err, IsNil)
+		c.Assert(fpath, Equals, filepath.Join(rootDir, path))
+	}
+	c.Assert(checked, DeepEquals, []string{"/", "/a/b", "/a/b/", "/a/..b", "/.../b"})
+}
+
+func (s *S) TestNewerThan(c *C) {
+	rootDir := c.MkDir()
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, offset := range map[string]int{"file1.txt": 0, "file2.txt": 1, "file3.txt": 1} {
+		fpath := filepath.Join(rootDir, name)
+		c.Assert(os.WriteFile(fpath, nil, 0644), IsNil)
+		t := mtime.Add(time.Duration(offset) * time.Second)
+		c.Assert(os.Chtimes(fpath, t, t), IsNil)
+	}
+	c.Assert(os.Symlink("file1.txt", filepath.Join(rootDir, "link")), IsNil)
+	content := &scripts.ContentValue{RootDir: rootDir}
+	namespace := map[string]scripts.Value{"content": content}
+
+	tests := []struct {
+		expr   string
+		result string
+		error  string
+	}{
+		{expr: `content.newer_than("/file2.txt", "/file1.txt")`, result: `True`},
+		{expr: `content.newer_than("/file1.txt", "/file2.txt")`, result: `False`},
+		{expr: `content.newer_than("/file2.txt", "/file3.txt")`, result: `False`},
+		{expr: `content.newer_than("/file2.txt", "/link")`, result: `True`},
+		{expr: `content.newer_than("/missing", "/file1.txt")`, result: `False`},
+		{expr: `content.newer_than("/file1.txt", "/missing")`, error: `stat /missing: no such file or directory`},
+	}
+	for _, test := range tests {
+		c.Logf("Expression: %s", test.expr)
+		result, err := evalExpr(namespace, test.expr)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result)
+	}
+}
+
+func (s *S) TestTruncate(c *C) {
+	for _, dryRun := range []bool{false, true} {
+		c.Logf("DryRun: %v", dryRun)
+		rootDir := c.MkDir()
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "file2.txt"), []byte("data2"), 0600), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "file3.txt"), []byte("data3"), 0644), IsNil)
+
+		var entries []fsutil.Entry
+		content := &scripts.ContentValue{
+			RootDir: rootDir,
+			DryRun:  dryRun,
+			OnWrite: func(entry *fsutil.Entry) error {
+				entries = append(entries, *entry)
+				return nil
+			},
+		}
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script: string(testutil.Reindent(`
+				content.truncate("/file1.txt", 3)
+				content.truncate("/file2.txt")
+				content.truncate("/file3.txt", size=8)
+			`)),
+		})
+		c.Assert(err, IsNil)
+		c.Assert(entries, DeepEquals, []fsutil.Entry{{
+			Path: "/file1.txt",
+			Mode: 0644,
+			Hash: "947d5a35ff2fe522fda5b431af955e3b27955ebc18c9e3684b07b51ae112461f",
+			Size: 3,
+		}, {
+			Path: "/file2.txt",
+			Mode: 0600,
+			Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			Size: 0,
+		}, {
+			Path: "/file3.txt",
+			Mode: 0644,
+			Hash: "5daa62fe111c99ef94417f099ec8280f3ee894f370d5d59bcdac3414873afb93",
+			Size: 8,
+		}})
+		if dryRun {
+			c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+				"/file1.txt": "file 0644 5b41362b",
+				"/file2.txt": "file 0600 d98cf53e",
+				"/file3.txt": "file 0644 f60f2d65",
+			})
 		} else {
+			c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+				"/file1.txt": "file 0644 947d5a35",
+				"/file2.txt": "file 0600 empty",
+				"/file3.txt": "file 0644 5daa62fe",
+			})
+		}
+
+		for _, test := range []struct{ script, error string }{
+			{`content.truncate("/missing.txt")`, `truncate /missing.txt: no such file or directory`},
+			{`content.truncate("/", 0)`, `cannot truncate non-regular file: /`},
+			{`content.truncate("/file1.txt", -1)`, `Content.truncate: size must not be negative`},
+		} {
+			err = scripts.Run(&scripts.RunOptions{
+				Namespace: map[string]scripts.Value{"content": content},
+				Script:    test.script,
+			})
+			c.Assert(err, ErrorMatches, test.error)
+		}
+	}
+}
+
+func (s *S) TestTruncateLimits(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+
+	content := &scripts.ContentValue{RootDir: rootDir, MaxWriteSize: 10}
+	err := scripts.Run(&scripts.RunOptions{
+		Content: content,
+		Script:  `content.truncate("/file1.txt", 11)`,
+	})
+	c.Assert(err, ErrorMatches, `write exceeds maximum size of 10 bytes: /file1.txt`)
+
+	// Hashing a huge extension is bounded in time, and fails before
+	// the file is changed.
+	content = &scripts.ContentValue{RootDir: rootDir, OpTimeout: 50 * time.Millisecond}
+	err = scripts.Run(&scripts.RunOptions{
+		Content: content,
+		Script:  `content.truncate("/file1.txt", 1024 * 1024 * 1024 * 1024)`,
+	})
+	c.Assert(err, ErrorMatches, `truncate /file1.txt: i/o timeout`)
+	c.Assert(errors.Is(err, os.ErrDeadlineExceeded), Equals, true)
+
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+	})
+}
+
+var normPathTests = []struct {
+	path   string
+	result string
+	error  string
+}{
+	{path: "/", result: `"/"`},
+	{path: "", result: `"/"`},
+	{path: "/foo/./bar", result: `"/foo/bar"`},
+	{path: "/foo//bar/", result: `"/foo/bar/"`},
+	{path: "/foo/..bar", result: `"/foo/..bar"`},
+	{path: "foo/bar", result: `"/foo/bar"`},
+	{path: "./foo/", result: `"/foo/"`},
+	{path: "/foo/../bar", error: `invalid content path: /foo/\.\./bar`},
+	{path: "/../foo", error: `invalid content path: /\.\./foo`},
+	{path: "foo/../bar", error: `invalid content path: foo/\.\./bar`},
+	{path: "foo/../../bar", error: `invalid content path: foo/\.\./\.\./bar`},
+	{path: "..", error: `invalid content path: \.\.`},
+}
+
+func (s *S) TestNormPath(c *C) {
+	rootDir := c.MkDir()
+	namespace := map[string]scripts.Value{
+		"content": &scripts.ContentValue{RootDir: rootDir},
+	}
+	for _, test := range normPathTests {
+		c.Logf("Path: %q", test.path)
+		result, err := evalExpr(namespace, fmt.Sprintf("content.normpath(%q)", test.path))
+		if test.error != "" {
 			c.Assert(err, ErrorMatches, test.error)
 			continue
 		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result)
+	}
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{})
+}
 
-		c.Assert(testutil.TreeDump(rootDir), DeepEquals, test.result)
+func (s *S) TestUmask(c *C) {
+	rootDir := c.MkDir()
+	var modes []fs.FileMode
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		Umask:   0066,
+		OnWrite: func(entry *fsutil.Entry) error {
+			modes = append(modes, entry.Mode)
+			return nil
+		},
 	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			content.write("/file1.txt", "data1")
+			content.mkdtemp("/")
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(modes, DeepEquals, []fs.FileMode{0600, fs.ModeDir | 0700})
+	c.Assert(testutil.TreeDump(rootDir)["/file1.txt"], Equals, "file 0600 5b41362b")
+
+	// Edited files keep their mode exactly, special bits included.
+	fpath := filepath.Join(rootDir, "file2.txt")
+	c.Assert(os.WriteFile(fpath, []byte("a=1\n"), 0644), IsNil)
+	c.Assert(os.Chmod(fpath, fs.ModeSetuid|fs.ModeSticky|0644), IsNil)
+	modes = nil
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.replace("/file2.txt", "a=1", "a=2")`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(modes, DeepEquals, []fs.FileMode{fs.ModeSetuid | fs.ModeSticky | 0644})
+	info, err := os.Stat(fpath)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode(), Equals, fs.ModeSetuid|fs.ModeSticky|0644)
+	c.Assert(testutil.TreeDump(rootDir)["/file2.txt"], Equals, "file 01644 e7a76728")
 }
 
-func (s *S) TestContentRelative(c *C) {
-	content := scripts.ContentValue{RootDir: "foo"}
-	_, err := content.RealPath("/bar", scripts.CheckNone)
-	c.Assert(err, ErrorMatches, "internal error: content defined with relative root: foo")
+func (s *S) TestSymlinkMode(c *C) {
+	setup := func() string {
+		rootDir := c.MkDir()
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+		c.Assert(os.Mkdir(filepath.Join(rootDir, "dir"), 0755), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "dir/file2.txt"), []byte("data2"), 0644), IsNil)
+		c.Assert(os.Symlink("file1.txt", filepath.Join(rootDir, "link")), IsNil)
+		c.Assert(os.Symlink("dir", filepath.Join(rootDir, "dirlink")), IsNil)
+		return rootDir
+	}
+	run := func(rootDir string, mode scripts.SymlinkMode, script string) error {
+		return scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{
+				"content": &scripts.ContentValue{RootDir: rootDir, SymlinkMode: mode},
+			},
+			Script: string(testutil.Reindent(script)),
+		})
+	}
+
+	rootDir := setup()
+	err := run(rootDir, scripts.FollowWithinRoot, `
+		content.write("/out.txt", content.read("/link") + content.read("/dirlink/file2.txt"))
+		content.write("/link", "data3")
+	`)
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/dir/":          "dir 0755",
+		"/dir/file2.txt": "file 0644 d98cf53e",
+		"/dirlink":       "symlink dir",
+		"/file1.txt":     "file 0644 f60f2d65", // "data3"
+		"/link":          "symlink file1.txt",
+		"/out.txt":       "file 0644 53ddc036", // "data1data2"
+	})
+
+	rootDir = setup()
+	err = run(rootDir, scripts.NeverFollow, `
+		content.write("/out.txt", content.read("/dirlink/file2.txt"))
+		content.write("/link", "data3")
+	`)
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/dir/":          "dir 0755",
+		"/dir/file2.txt": "file 0644 d98cf53e",
+		"/dirlink":       "symlink dir",
+		"/file1.txt":     "file 0644 5b41362b",
+		"/link":          "file 0644 f60f2d65", // "data3"
+		"/out.txt":       "file 0644 d98cf53e",
+	})
+	err = run(setup(), scripts.NeverFollow, `content.read("/link")`)
+	c.Assert(err, ErrorMatches, "open /link: too many levels of symbolic links")
+
+	rootDir = setup()
+	err = run(rootDir, scripts.Reject, `content.write("/dir/out.txt", content.read("/file1.txt"))`)
+	c.Assert(err, IsNil)
+	err = run(rootDir, scripts.Reject, `content.read("/link")`)
+	c.Assert(err, ErrorMatches, "content path has symlink: /link")
+	err = run(rootDir, scripts.Reject, `content.write("/dirlink/file3.txt", "data3")`)
+	c.Assert(err, ErrorMatches, "content path has symlink: /dirlink")
+}
+
+func (s *S) TestCopyTree(c *C) {
+	for _, dryRun := range []bool{false, true} {
+		c.Logf("DryRun: %v", dryRun)
+		rootDir := c.MkDir()
+		c.Assert(os.MkdirAll(filepath.Join(rootDir, "src/sub"), 0755), IsNil)
+		c.Assert(os.Chmod(filepath.Join(rootDir, "src/sub"), 0700), IsNil)
+		c.Assert(os.MkdirAll(filepath.Join(rootDir, "src/.git"), 0755), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "src/file1.txt"), []byte("data1"), 0600), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "src/sub/file2.txt"), []byte("data2"), 0644), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "src/sub/file3.o"), []byte("data3"), 0644), IsNil)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "src/.git/config"), []byte("data3"), 0644), IsNil)
+		c.Assert(os.Symlink("../file1.txt", filepath.Join(rootDir, "src/sub/link")), IsNil)
+
+		var entries []fsutil.Entry
+		content := &scripts.ContentValue{
+			RootDir: rootDir,
+			DryRun:  dryRun,
+			CheckRead: func(path string) error {
+				if strings.HasPrefix(path, "/src/.git/") {
+					return fmt.Errorf("excluded path was read: %s", path)
+				}
+				return nil
+			},
+			OnWrite: func(entry *fsutil.Entry) error {
+				entries = append(entries, *entry)
+				return nil
+			},
+		}
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    `content.copy_tree("/src", "/dst", exclude=["/src/.git/", "/src/**.o"])`,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(entries, DeepEquals, []fsutil.Entry{{
+			Path: "/dst/",
+			Mode: fs.ModeDir | 0755,
+		}, {
+			Path: "/dst/file1.txt",
+			Mode: 0600,
+			Hash: "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9",
+			Size: 5,
+		}, {
+			Path: "/dst/sub/",
+			Mode: fs.ModeDir | 0700,
+		}, {
+			Path: "/dst/sub/file2.txt",
+			Mode: 0644,
+			Hash: "d98cf53e0c8b77c14a96358d5b69584225b4bb9026423cbc2f7b0161894c402c",
+			Size: 5,
+		}, {
+			Path: "/dst/sub/link",
+			Mode: fs.ModeSymlink | 0777,
+			Link: "../file1.txt",
+		}})
+		if !dryRun {
+			dump := testutil.TreeDump(rootDir)
+			for path, value := range map[string]string{
+				"/dst/":              "dir 0755",
+				"/dst/file1.txt":     "file 0600 5b41362b",
+				"/dst/sub/":          "dir 0700",
+				"/dst/sub/file2.txt": "file 0644 d98cf53e",
+				"/dst/sub/link":      "symlink ../file1.txt",
+			} {
+				c.Assert(dump[path], Equals, value, Commentf("%s", path))
+			}
+			c.Assert(dump["/dst/.git/"], Equals, "")
+			c.Assert(dump["/dst/sub/file3.o"], Equals, "")
+		}
+
+		for _, test := range []struct{ script, error string }{
+			{`content.copy_tree("/src", "/src/sub/dst")`, `cannot copy /src into itself`},
+			{`content.copy_tree("/src/file1.txt", "/dst")`, `content path is not a directory: /src/file1.txt`},
+			{`content.copy_tree("/src", "/dst", exclude=[1])`, `Content.copy_tree: exclude must be a list of strings, got int in list`},
+		} {
+			err = scripts.Run(&scripts.RunOptions{
+				Namespace: map[string]scripts.Value{"content": content},
+				Script:    test.script,
+			})
+			c.Assert(err, ErrorMatches, test.error)
+		}
+	}
+}
+
+func (s *S) TestHardlink(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file2.txt"), []byte("data2"), 0644), IsNil)
+	c.Assert(os.Symlink("file1.txt", filepath.Join(rootDir, "link")), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "dir"), 0755), IsNil)
+
+	var entries []fsutil.Entry
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			entries = append(entries, *entry)
+			return nil
+		},
+	}
+	run := func(script string) error {
+		return scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    script,
+		})
+	}
+
+	c.Assert(run(`content.hardlink("/file1.txt", "/dir/file3.txt")`), IsNil)
+	c.Assert(run(`content.hardlink("/file1.txt", "/file2.txt", force=True)`), IsNil)
+	c.Assert(entries, DeepEquals, []fsutil.Entry{{
+		Path: "/dir/file3.txt",
+		Mode: 0644,
+		Hash: "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9",
+		Size: 5,
+	}, {
+		Path: "/file2.txt",
+		Mode: 0644,
+		Hash: "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9",
+		Size: 5,
+	}})
+	info1, err := os.Stat(filepath.Join(rootDir, "file1.txt"))
+	c.Assert(err, IsNil)
+	for _, path := range []string{"dir/file3.txt", "file2.txt"} {
+		info, err := os.Stat(filepath.Join(rootDir, path))
+		c.Assert(err, IsNil)
+		c.Assert(os.SameFile(info1, info), Equals, true)
+	}
+
+	err = run(`content.hardlink("/file1.txt", "/file2.txt")`)
+	c.Assert(err, ErrorMatches, "link /file2.txt: file exists")
+	err = run(`content.hardlink("/file1.txt", "/dir", force=True)`)
+	c.Assert(err, ErrorMatches, "link /dir: file exists")
+	err = run(`content.hardlink("/link", "/file4.txt")`)
+	c.Assert(err, ErrorMatches, "cannot hardlink to non-regular file: /link")
+	err = run(`content.hardlink("/dir", "/file4.txt")`)
+	c.Assert(err, ErrorMatches, "cannot hardlink to non-regular file: /dir")
+	err = run(`content.hardlink("/../file1.txt", "/file4.txt")`)
+	c.Assert(err, ErrorMatches, "invalid content path: /../file1.txt")
+	err = run(`content.hardlink("/file1.txt", "/../file4.txt")`)
+	c.Assert(err, ErrorMatches, "invalid content path: /../file4.txt")
+	err = run(`content.hardlink("/missing.txt", "/file4.txt")`)
+	c.Assert(err, ErrorMatches, "lstat /missing.txt: no such file or directory")
+
+	// A failed link doesn't lose the entry being replaced.
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "dir/file4.txt"), []byte("data3"), 0644), IsNil)
+	restore := scripts.FakeRename(func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EIO}
+	})
+	defer restore()
+	err = run(`content.hardlink("/file1.txt", "/dir/file4.txt", force=True)`)
+	c.Assert(err, ErrorMatches, "rename /dir/file4.txt: input/output error")
+	var werr *scripts.WriteError
+	c.Assert(errors.As(err, &werr), Equals, true)
+	c.Assert(werr.Path, Equals, "/dir/file4.txt")
+	c.Assert(testutil.TreeDump(filepath.Join(rootDir, "dir")), DeepEquals, map[string]string{
+		"/file3.txt": "file 0644 5b41362b",
+		"/file4.txt": "file 0644 f60f2d65",
+	})
+}
+
+func (s *S) TestExposeRoot(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "foo"), 0755), IsNil)
+
+	content := &scripts.ContentValue{RootDir: rootDir}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.root`,
+	})
+	c.Assert(err, ErrorMatches, `.*Content has no .root field or method`)
+	c.Assert(content.AttrNames(), Not(testutil.Contains), "root")
+
+	content.ExposeRoot = true
+	c.Assert(content.AttrNames(), testutil.Contains, "root")
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			content.write("/root.txt", content.root)
+			content.write("/foo/root.txt", content.sub("/foo").root)
+		`)),
+	})
+	c.Assert(err, IsNil)
+	data, err := os.ReadFile(filepath.Join(rootDir, "root.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, rootDir)
+	data, err = os.ReadFile(filepath.Join(rootDir, "foo/root.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, filepath.Join(rootDir, "foo"))
+}
+
+func (s *S) TestChown(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+	c.Assert(os.Symlink("file1.txt", filepath.Join(rootDir, "link")), IsNil)
+
+	var entries []fsutil.Entry
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			entries = append(entries, *entry)
+			return nil
+		},
+	}
+	c.Assert(content.AttrNames(), Not(testutil.Contains), "chown")
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.chown("/file1.txt", 0, 0)`,
+	})
+	c.Assert(err, ErrorMatches, `.*Content has no .chown field or method`)
+
+	// Changing ownership to the current user and group needs no privileges.
+	uid, gid := os.Getuid(), os.Getgid()
+	content.AllowChown = true
+	c.Assert(content.AttrNames(), testutil.Contains, "chown")
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    fmt.Sprintf(`content.chown("/file1.txt", %d, %d)`, uid, gid),
+	})
+	c.Assert(err, IsNil)
+
+	// Recorded ownership is reported but not applied.
+	content.RecordOwnership = true
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			content.chown("/", 12345, 54321)
+			content.chown("/link", 12345, 54321)
+		`)),
+	})
+	c.Assert(err, IsNil)
+	info, err := os.Stat(rootDir)
+	c.Assert(err, IsNil)
+	c.Assert(int(info.Sys().(*syscall.Stat_t).Uid), Equals, uid)
+
+	c.Assert(entries, DeepEquals, []fsutil.Entry{{
+		Path:  "/file1.txt",
+		Mode:  0644,
+		Hash:  "5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9",
+		Size:  5,
+		Owner: &fsutil.Owner{UID: uid, GID: gid},
+	}, {
+		Path:  "/",
+		Mode:  fs.ModeDir | 0700,
+		Owner: &fsutil.Owner{UID: 12345, GID: 54321},
+	}, {
+		Path:  "/link",
+		Mode:  fs.ModeSymlink | 0777,
+		Link:  "file1.txt",
+		Owner: &fsutil.Owner{UID: 12345, GID: 54321},
+	}})
+
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.chown("/missing.txt", 0, 0)`,
+	})
+	c.Assert(err, ErrorMatches, `lstat /missing.txt: no such file or directory`)
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.chown("/file1.txt", -1, 0)`,
+	})
+	c.Assert(err, ErrorMatches, `Content.chown: ids must not be negative`)
+}
+
+func (s *S) TestReplaceAtomic(c *C) {
+	restore := scripts.FakeRename(func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EIO}
+	})
+	defer restore()
+
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file.txt"), []byte("a=1\n"), 0644), IsNil)
+
+	var written []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			written = append(written, entry.Path)
+			return nil
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Content: content,
+		Script:  `content.replace("/file.txt", "a=1", "a=2")`,
+	})
+	c.Assert(err, ErrorMatches, `rename /file.txt: input/output error`)
+	c.Assert(written, HasLen, 0)
+
+	// The original file is left as it was, and the temporary one is gone.
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file.txt": "file 0644 fe3209d6", // "a=1\n"
+	})
+}
+
+func (s *S) TestMoveInto(c *C) {
+	hostDir, err := filepath.EvalSymlinks(c.MkDir())
+	c.Assert(err, IsNil)
+	hostPath := filepath.Join(hostDir, "file1.txt")
+	c.Assert(os.WriteFile(hostPath, []byte("data1"), 0644), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(hostDir, "secret.txt"), nil, 0644), IsNil)
+
+	rootDir := c.MkDir()
+	content := &scripts.ContentValue{RootDir: rootDir}
+	c.Assert(content.AttrNames(), Not(testutil.Contains), "move_into")
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    fmt.Sprintf(`content.move_into(%q, "/file1.txt")`, hostPath),
+	})
+	c.Assert(err, ErrorMatches, `.*Content has no .?move_into.? field or method`)
+
+	content.AllowImport = func(hostPath string) error {
+		if filepath.Base(hostPath) != "file1.txt" {
+			return fmt.Errorf("cannot import %s", hostPath)
+		}
+		return nil
+	}
+	c.Assert(content.AttrNames(), testutil.Contains, "move_into")
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    fmt.Sprintf(`content.move_into(%q, "/file2.txt")`, hostPath),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file2.txt": "file 0644 5b41362b",
+	})
+	c.Assert(testutil.TreeDump(hostDir)["/file1.txt"], Equals, "file 0644 5b41362b")
+
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    fmt.Sprintf(`content.move_into(%q, "/file3.txt")`, hostDir+"/foo/../secret.txt"),
+	})
+	c.Assert(err, ErrorMatches, "cannot import "+hostDir+"/secret.txt")
+
+	// Symlinks are resolved before asking, so an allowed name cannot
+	// point elsewhere.
+	linkDir := c.MkDir()
+	c.Assert(os.Symlink(filepath.Join(hostDir, "secret.txt"), filepath.Join(linkDir, "file1.txt")), IsNil)
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    fmt.Sprintf(`content.move_into(%q, "/file4.txt")`, linkDir+"/file1.txt"),
+	})
+	c.Assert(err, ErrorMatches, "cannot import "+hostDir+"/secret.txt")
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file2.txt": "file 0644 5b41362b",
+	})
+
+	// Values obtained via sub keep the policy.
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "dir"), 0755), IsNil)
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(fmt.Sprintf(`
+			sub = content.sub("/dir")
+			sub.move_into(%q, "/file5.txt")
+			sub.move_into(%q, "/file6.txt")
+		`, hostPath, hostDir+"/secret.txt"))),
+	})
+	c.Assert(err, ErrorMatches, "cannot import "+hostDir+"/secret.txt")
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file2.txt":     "file 0644 5b41362b",
+		"/dir/":          "dir 0755",
+		"/dir/file5.txt": "file 0644 5b41362b",
+	})
+
+	// Named pipes are refused without waiting for a writer, and reading
+	// large files is bounded by OpTimeout.
+	c.Assert(syscall.Mkfifo(filepath.Join(hostDir, "fifo"), 0644), IsNil)
+	bigPath := filepath.Join(hostDir, "big.txt")
+	c.Assert(os.WriteFile(bigPath, nil, 0644), IsNil)
+	c.Assert(os.Truncate(bigPath, 1<<40), IsNil)
+	content = &scripts.ContentValue{
+		RootDir:     rootDir,
+		DryRun:      true,
+		OpTimeout:   50 * time.Millisecond,
+		AllowImport: func(hostPath string) error { return nil },
+	}
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    fmt.Sprintf(`content.move_into(%q, "/file7.txt")`, hostDir+"/fifo"),
+	})
+	c.Assert(err, ErrorMatches, "cannot import non-regular file: "+hostDir+"/fifo")
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    fmt.Sprintf(`content.move_into(%q, "/file7.txt")`, bigPath),
+	})
+	c.Assert(err, ErrorMatches, "read /file7.txt: i/o timeout")
+}
+
+func (s *S) TestFreeze(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+	content := &scripts.ContentValue{RootDir: rootDir}
+	content.Freeze()
+
+	for _, script := range []string{
+		`content.write("/file1.txt", "data2")`,
+		`content.touch("/file2.txt")`,
+		`content.sub("/").write_json("/file2.txt", {})`,
+		`content.mktemp()`,
+	} {
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    script,
+		})
+		c.Assert(err, ErrorMatches, "cannot write to frozen Content")
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.read("/file1.txt") + str(content.list("/"))`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+	})
+}
+
+func (s *S) TestReadOnly(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "foo"), 0755), IsNil)
+	content := &scripts.ContentValue{RootDir: rootDir, ReadOnly: true}
+	names := content.AttrNames()
+	c.Assert(names, testutil.Contains, "read")
+	c.Assert(names, testutil.Contains, "list")
+	c.Assert(names, Not(testutil.Contains), "write")
+	c.Assert(names, Not(testutil.Contains), "mkdir")
+	c.Assert(names, Not(testutil.Contains), "open_write")
+
+	err := scripts.Run(&scripts.RunOptions{
+		Content: content,
+		Script: string(testutil.Reindent(`
+			if content.read("/file1.txt") != "data1":
+				fail("unexpected data")
+			if not content.sub("/foo").is_empty("/"):
+				fail("unexpected entries")
+			if "write" in content.help():
+				fail("write listed in help")
+		`)),
+	})
+	c.Assert(err, IsNil)
+
+	for _, script := range []string{
+		`content.write("/file1.txt", "data2")`,
+		`content.sub("/foo").write("/file1.txt", "data2")`,
+	} {
+		err = scripts.Run(&scripts.RunOptions{Content: content, Script: script})
+		c.Assert(err, ErrorMatches, `.*Content has no .write field or method`)
+	}
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+		"/foo/":      "dir 0755",
+	})
+}
+
+func (s *S) TestIterate(c *C) {
+	rootDir := c.MkDir()
+	var want []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, name), nil, 0644), IsNil)
+		want = append(want, name)
+	}
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "dir"), 0755), IsNil)
+	want = append(want, "dir/")
+	sort.Strings(want)
+
+	var audited []string
+	content := &scripts.ContentValue{
+		RootDir:       rootDir,
+		ListChunkSize: 4,
+		Audit: func(op string, path string, err error) {
+			audited = append(audited, fmt.Sprintf("%s %s %v", op, path, err))
+		},
+	}
+	namespace := map[string]scripts.Value{"content": content}
+
+	// Names span several chunks.
+	result, err := evalExpr(namespace, `" ".join(sorted(content))`)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, strconv.Quote(strings.Join(want, " ")))
+
+	// Abandoning the iteration releases the directory as well.
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: namespace,
+		Script: string(testutil.Reindent(`
+			for name in content:
+				break
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(audited, DeepEquals, []string{"iterate / <nil>", "iterate / <nil>"})
+
+	// Errors fail the run using the value.
+	content.RootDir = filepath.Join(rootDir, "missing")
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: namespace,
+		Script: string(testutil.Reindent(`
+			names = []
+			for name in content:
+				names.append(name)
+			content.write("/file.txt", "data")
+		`)),
+	})
+	c.Assert(err, ErrorMatches, `open /: no such file or directory`)
+	c.Assert(errors.Is(err, os.ErrNotExist), Equals, true)
+
+	// Without a run, the value is not iterable instead.
+	c.Assert(content.Iterate(), IsNil)
+	c.Assert(audited[len(audited)-1], Equals, "iterate / open /: no such file or directory")
+
+	// And the directory is read up front, so failures cannot cut the
+	// names short.
+	content.RootDir = rootDir
+	iter := content.Iterate()
+	c.Assert(os.Remove(filepath.Join(rootDir, "file0.txt")), IsNil)
+	names := []string{}
+	var value scripts.Value
+	for iter.Next(&value) {
+		names = append(names, string(value.(starlark.String)))
+	}
+	iter.Done()
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, want)
+}
+
+func (s *S) TestClose(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0644), IsNil)
+	content := &scripts.ContentValue{RootDir: rootDir}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			w = content.open_write("/file2.txt")
+			content.close()
+			content.close()
+			w.write("data2")
+		`)),
+	})
+	c.Assert(err, ErrorMatches, "cannot write to frozen Content")
+
+	for _, script := range []string{
+		`content.read("/file1.txt")`,
+		`content.write("/file1.txt", "data2")`,
+		`content.help()`,
+	} {
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    script,
+		})
+		c.Assert(err, ErrorMatches, "cannot use closed Content")
+	}
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `[name for name in content]`,
+	})
+	c.Assert(err, ErrorMatches, "cannot use closed Content")
+
+	content = &scripts.ContentValue{RootDir: rootDir}
+	c.Assert(content.Close(), IsNil)
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.read("/file1.txt")`,
+	})
+	c.Assert(err, ErrorMatches, "cannot use closed Content")
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/file1.txt": "file 0644 5b41362b",
+		"/file2.txt": "file 0644 empty",
+	})
+}
+
+func (s *S) TestMakeParents(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "a"), 0755), IsNil)
+	var paths []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			paths = append(paths, fmt.Sprintf("%s %s", entry.Path, entry.Mode))
+			return nil
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			content.write("/a/b/c/file1.txt", "data1", make_parents=True)
+			content.mkdir("/a/b/d")
+			content.mkdir("/x/y/", make_parents=True)
+			content.mkdir("/x/y/", make_parents=True)
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/a/":              "dir 0755",
+		"/a/b/":            "dir 0755",
+		"/a/b/c/":          "dir 0755",
+		"/a/b/c/file1.txt": "file 0644 5b41362b",
+		"/a/b/d/":          "dir 0755",
+		"/x/":              "dir 0755",
+		"/x/y/":            "dir 0755",
+	})
+	c.Assert(paths, DeepEquals, []string{
+		"/a/b/ drwxr-xr-x",
+		"/a/b/c/ drwxr-xr-x",
+		"/a/b/c/file1.txt -rw-r--r--",
+		"/a/b/d/ drwxr-xr-x",
+		"/x/ drwxr-xr-x",
+		"/x/y/ drwxr-xr-x",
+	})
+}
+
+func (s *S) TestMove(c *C) {
+	for _, crossDevice := range []bool{false, true} {
+		for _, dryRun := range []bool{false, true} {
+			c.Logf("Cross device: %v, DryRun: %v", crossDevice, dryRun)
+			var renames int
+			restore := scripts.FakeRename(func(oldpath, newpath string) error {
+				renames++
+				if crossDevice {
+					return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+				}
+				return os.Rename(oldpath, newpath)
+			})
+			defer restore()
+
+			rootDir := c.MkDir()
+			c.Assert(os.Mkdir(filepath.Join(rootDir, "a"), 0755), IsNil)
+			c.Assert(os.WriteFile(filepath.Join(rootDir, "file1.txt"), []byte("data1"), 0600), IsNil)
+			c.Assert(os.WriteFile(filepath.Join(rootDir, "a/file2.txt"), []byte("data2"), 0644), IsNil)
+			c.Assert(os.Symlink("file2.txt", filepath.Join(rootDir, "link")), IsNil)
+
+			var events []string
+			content := &scripts.ContentValue{
+				RootDir: rootDir,
+				DryRun:  dryRun,
+				OnWrite: func(entry *fsutil.Entry) error {
+					events = append(events, fmt.Sprintf("write %s %s %s %s", entry.Path, entry.Mode, entry.Hash, entry.Link))
+					return nil
+				},
+				OnRemove: func(path string) error {
+					events = append(events, "remove "+path)
+					return nil
+				},
+			}
+			err := scripts.Run(&scripts.RunOptions{
+				Namespace: map[string]scripts.Value{"content": content},
+				Script: string(testutil.Reindent(`
+					content.move("/file1.txt", "/a/file2.txt")
+					content.move("/link", "/a/link")
+				`)),
+			})
+			c.Assert(err, IsNil)
+			c.Assert(events, DeepEquals, []string{
+				"write /a/file2.txt -rw------- 5b41362bc82b7f3d56edc5a306db22105707d01ff4819e26faef9724a2d406c9 ",
+				"remove /file1.txt",
+				"write /a/link Lrwxrwxrwx  file2.txt",
+				"remove /link",
+			})
+			if dryRun {
+				c.Assert(renames, Equals, 0)
+				c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+					"/a/":          "dir 0755",
+					"/a/file2.txt": "file 0644 d98cf53e",
+					"/file1.txt":   "file 0600 5b41362b",
+					"/link":        "symlink file2.txt",
+				})
+			} else {
+				c.Assert(renames, Equals, 2)
+				c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+					"/a/":          "dir 0755",
+					"/a/file2.txt": "file 0600 5b41362b",
+					"/a/link":      "symlink file2.txt",
+				})
+			}
+		}
+	}
 }
+
+var moveErrorTests = []struct {
+	script string
+	error  string
+}{
+	{`content.move("/a", "/b")`, `cannot move directory: /a`},
+	{`content.move("/missing", "/b")`, `lstat /missing: no such file or directory`},
+	{`content.move("/a/file1.txt", "/missing/file1.txt")`, `rename /missing/file1.txt: no such file or directory`},
+}
+
+func (s *S) TestMoveErrors(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "a"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "a/file1.txt"), []byte("data1"), 0644), IsNil)
+	content := &scripts.ContentValue{RootDir: rootDir}
+	for _, test := range moveErrorTests {
+		c.Logf("Script: %s", test.script)
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    test.script,
+		})
+		c.Assert(err, ErrorMatches, test.error)
+	}
+}
+
+func (s *S) TestListChunkSize(c *C) {
+	rootDir := c.MkDir()
+	var expected []string
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("file%02d.txt", i)
+		c.Assert(os.WriteFile(filepath.Join(rootDir, name), nil, 0644), IsNil)
+		expected = append(expected, fmt.Sprintf("%q", name))
+	}
+	for _, size := range []int{0, 1, 7, 16, 49, 50, 1000} {
+		c.Logf("ListChunkSize: %d", size)
+		content := &scripts.ContentValue{RootDir: rootDir, ListChunkSize: size}
+		result, err := evalExpr(map[string]scripts.Value{"content": content}, `content.list("/")`)
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, "["+strings.Join(expected, ", ")+"]")
+	}
+}
+
+func (s *S) TestOnConflict(c *C) {
+	data22 := fmt.Sprintf("%x", sha256.Sum256([]byte("data22")))[:8]
+	for _, dryRun := range []bool{false, true} {
+		c.Logf("DryRun: %v", dryRun)
+		rootDir := c.MkDir()
+		c.Assert(os.Mkdir(filepath.Join(rootDir, "foo"), 0755), IsNil)
+		for _, name := range []string{"base.txt", "new.txt", "abort.txt"} {
+			c.Assert(os.WriteFile(filepath.Join(rootDir, "foo", name), []byte("data1"), 0644), IsNil)
+		}
+
+		var conflicts, writes []string
+		content := &scripts.ContentValue{
+			RootDir: rootDir,
+			DryRun:  dryRun,
+			OnConflict: func(path string, existing, incoming *fsutil.Entry) (scripts.Decision, error) {
+				conflicts = append(conflicts, fmt.Sprintf("%s %s %d %s %d", path, existing.Hash[:8], existing.Size, incoming.Hash[:8], incoming.Size))
+				switch filepath.Base(path) {
+				case "base.txt":
+					return scripts.Skip, nil
+				case "abort.txt":
+					return scripts.Abort, nil
+				case "error.txt":
+					return scripts.Overwrite, fmt.Errorf("refusing")
+				}
+				return scripts.Overwrite, nil
+			},
+			OnWrite: func(entry *fsutil.Entry) error {
+				writes = append(writes, entry.Path)
+				return nil
+			},
+		}
+		run := func(script string) error {
+			return scripts.Run(&scripts.RunOptions{
+				Content: content,
+				Script:  string(testutil.Reindent(script)),
+			})
+		}
+		err := run(`
+			entry = content.write("/foo/base.txt", "data2")
+			if entry.size != 5 or entry.hash[:8] != "5b41362b":
+				fail("unexpected entry: %r" % entry)
+			content.sub("/foo").write("/new.txt", "data22")
+			content.write("/foo/other.txt", "data3")
+		`)
+		c.Assert(err, IsNil)
+		c.Assert(conflicts, DeepEquals, []string{
+			"/foo/base.txt 5b41362b 5 d98cf53e 5",
+			"/foo/new.txt 5b41362b 5 " + data22 + " 6",
+		})
+		c.Assert(writes, DeepEquals, []string{"/foo/new.txt", "/foo/other.txt"})
+
+		err = run(`content.write("/foo/abort.txt", "data2")`)
+		c.Assert(err, ErrorMatches, "cannot overwrite existing file: /foo/abort.txt")
+		c.Assert(os.WriteFile(filepath.Join(rootDir, "foo/error.txt"), nil, 0644), IsNil)
+		err = run(`content.write("/foo/error.txt", "data2")`)
+		c.Assert(err, ErrorMatches, "refusing")
+		c.Assert(writes, HasLen, 2)
+
+		if !dryRun {
+			c.Assert(testutil.TreeDump(filepath.Join(rootDir, "foo")), DeepEquals, map[string]string{
+				"/abort.txt": "file 0644 5b41362b",
+				"/base.txt":  "file 0644 5b41362b",
+				"/error.txt": "file 0644 empty",
+				"/new.txt":   "file 0644 " + data22,
+				"/other.txt": "file 0644 f60f2d65",
+			})
+		}
+	}
+}
+
+func (s *S) TestWriteParentsOrder(c *C) {
+	for _, dryRun := range []bool{false, true} {
+		c.Logf("DryRun: %v", dryRun)
+		rootDir := c.MkDir()
+		c.Assert(os.Mkdir(filepath.Join(rootDir, "a"), 0755), IsNil)
+		var paths []string
+		content := &scripts.ContentValue{
+			RootDir: rootDir,
+			DryRun:  dryRun,
+			OnWrite: func(entry *fsutil.Entry) error {
+				paths = append(paths, entry.Path)
+				return nil
+			},
+		}
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script: string(testutil.Reindent(`
+				content.write("/a/b/c/d/file1.txt", "data1", make_parents=True)
+				content.sub("/a").write("/e/f/file2.txt", "data2", make_parents=True)
+			`)),
+		})
+		c.Assert(err, IsNil)
+		c.Assert(paths, DeepEquals, []string{
+			"/a/b/",
+			"/a/b/c/",
+			"/a/b/c/d/",
+			"/a/b/c/d/file1.txt",
+			"/a/e/",
+			"/a/e/f/",
+			"/a/e/f/file2.txt",
+		})
+	}
+}
+
+func (s *S) TestListPage(c *C) {
+	rootDir := c.MkDir()
+	for i := 0; i < 25; i++ {
+		if i%5 == 0 {
+			c.Assert(os.Mkdir(filepath.Join(rootDir, fmt.Sprintf("dir%02d", i)), 0755), IsNil)
+		} else {
+			c.Assert(os.WriteFile(filepath.Join(rootDir, fmt.Sprintf("file%02d", i)), nil, 0644), IsNil)
+		}
+	}
+	content := &scripts.ContentValue{RootDir: rootDir, ListChunkSize: 7}
+	for _, test := range []struct {
+		limit int
+		pages string
+	}{
+		{limit: 10, pages: "[10, 10, 5]"},
+		{limit: 5, pages: "[5, 5, 5, 5, 5]"},
+		{limit: 25, pages: "[25]"},
+		{limit: 100, pages: "[25]"},
+		{limit: 1, pages: "[1" + strings.Repeat(", 1", 24) + "]"},
+	} {
+		c.Logf("Limit: %d", test.limit)
+		err := scripts.Run(&scripts.RunOptions{
+			Content: content,
+			Script: string(testutil.Reindent(fmt.Sprintf(`
+				names = []
+				pages = []
+				cursor = None
+				for i in range(100):
+					page, cursor = content.list_page("/", cursor, limit=%d)
+					names.extend(page)
+					pages.append(len(page))
+					if cursor == None:
+						break
+				if names != content.list("/"):
+					fail("unexpected names: %%r", names)
+				if str(pages) != %q:
+					fail("unexpected pages: %%r", pages)
+			`, test.limit, test.pages))),
+		})
+		c.Assert(err, IsNil)
+	}
+
+	for _, test := range []struct {
+		expr  string
+		error string
+	}{
+		{`content.list_page("/", limit=0)`, `Content.list_page: limit must be positive`},
+		{`content.list_page("/", 1)`, `Content.list_page: for parameter cursor: got int, want string or None`},
+		{`content.list_page("/missing")`, `open /missing: no such file or directory`},
+	} {
+		_, err := evalExpr(map[string]scripts.Value{"content": content}, test.expr)
+		c.Assert(err, ErrorMatches, test.error)
+	}
+}
+
+func (s *S) TestEnsureDir(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "a"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "a/file1.txt"), nil, 0644), IsNil)
+	var paths []string
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		OnWrite: func(entry *fsutil.Entry) error {
+			paths = append(paths, entry.Path)
+			return nil
+		},
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script: string(testutil.Reindent(`
+			content.ensure_dir("/a")
+			content.ensure_dir("/a/b/c")
+			content.ensure_dir("/a/b/c/")
+			content.ensure_dir("/a/b/d")
+		`)),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/a/":          "dir 0755",
+		"/a/file1.txt": "file 0644 empty",
+		"/a/b/":        "dir 0755",
+		"/a/b/c/":      "dir 0755",
+		"/a/b/d/":      "dir 0755",
+	})
+	c.Assert(paths, DeepEquals, []string{"/a/b/", "/a/b/c/", "/a/b/d/"})
+
+	err = scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{"content": content},
+		Script:    `content.ensure_dir("/a/file1.txt")`,
+	})
+	c.Assert(err, ErrorMatches, "content path is not a directory: /a/file1.txt")
+}
+
+var mkdirErrorTests = []struct {
+	script string
+	error  string
+}{
+	{`content.mkdir("/a")`, `mkdir /a: file exists`},
+	{`content.mkdir("/m/n")`, `mkdir /m/n: no such file or directory`},
+	{`content.mkdir("/a/file1.txt/b", make_parents=True)`, `content path is not a directory: /a/file1.txt`},
+	{`content.write("/a/deny/b/file2.txt", "", make_parents=True)`, `no write: /a/deny/`},
+	{`content.mkdir("a/b", make_parents=True)`, `content path must be absolute, got: a/b`},
+}
+
+func (s *S) TestMkdirErrors(c *C) {
+	rootDir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(rootDir, "a"), 0755), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(rootDir, "a/file1.txt"), nil, 0644), IsNil)
+	content := &scripts.ContentValue{
+		RootDir: rootDir,
+		CheckWrite: func(path string) error {
+			if strings.Contains(path, "/deny/") {
+				return fmt.Errorf("no write: %s", path)
+			}
+			return nil
+		},
+	}
+	for _, test := range mkdirErrorTests {
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    test.script,
+		})
+		c.Assert(err, ErrorMatches, test.error)
+	}
+	c.Assert(testutil.TreeDump(rootDir), DeepEquals, map[string]string{
+		"/a/":          "dir 0755",
+		"/a/file1.txt": "file 0644 empty",
+	})
+}
+
+func benchmarkList(b *testing.B, chunkSize int) {
+	rootDir := b.TempDir()
+	for i := 0; i < 20000; i++ {
+		err := os.WriteFile(filepath.Join(rootDir, fmt.Sprintf("file%06d", i)), nil, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	content := &scripts.ContentValue{RootDir: rootDir, ListChunkSize: chunkSize}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := scripts.Run(&scripts.RunOptions{
+			Namespace: map[string]scripts.Value{"content": content},
+			Script:    `content.list("/")`,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListChunk16(b *testing.B)   { benchmarkList(b, 16) }
+func BenchmarkListChunk1024(b *testing.B) { benchmarkList(b, 1024) }
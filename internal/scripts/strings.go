@@ -0,0 +1,117 @@
+package scripts
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// StringsModule returns a module with string helpers that behave as the
+// Python str methods of the same name. It's meant to be added to the
+// namespace of scripts, usually under the "strings" name.
+func StringsModule() Value {
+	return &starlarkstruct.Module{
+		Name: "strings",
+		Members: starlark.StringDict{
+			"splitlines":   starlark.NewBuiltin("strings.splitlines", stringsSplitLines),
+			"removeprefix": starlark.NewBuiltin("strings.removeprefix", stringsRemovePrefix),
+			"removesuffix": starlark.NewBuiltin("strings.removesuffix", stringsRemoveSuffix),
+			"ljust":        starlark.NewBuiltin("strings.ljust", stringsJustify),
+			"rjust":        starlark.NewBuiltin("strings.rjust", stringsJustify),
+			"partition":    starlark.NewBuiltin("strings.partition", stringsPartition),
+		},
+	}
+}
+
+// lineBreaks holds the line boundaries recognized by Python's
+// str.splitlines, except for "\r\n" which is handled separately.
+const lineBreaks = "\n\r\v\f\x1c\x1d\x1e\u0085\u2028\u2029"
+
+func stringsSplitLines(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var s string
+	var keepends bool
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "s", &s, "keepends?", &keepends)
+	if err != nil {
+		return nil, err
+	}
+	var values []Value
+	for s != "" {
+		i := strings.IndexAny(s, lineBreaks)
+		if i < 0 {
+			values = append(values, starlark.String(s))
+			break
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		if strings.HasPrefix(s[i:], "\r\n") {
+			size = 2
+		}
+		end := i
+		if keepends {
+			end += size
+		}
+		values = append(values, starlark.String(s[:end]))
+		s = s[i+size:]
+	}
+	return starlark.NewList(values), nil
+}
+
+func stringsRemovePrefix(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var s, prefix string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "s", &s, "prefix", &prefix)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(strings.TrimPrefix(s, prefix)), nil
+}
+
+func stringsRemoveSuffix(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var s, suffix string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "s", &s, "suffix", &suffix)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(strings.TrimSuffix(s, suffix)), nil
+}
+
+// stringsJustify implements both strings.ljust and strings.rjust. As in
+// Python, width is measured in characters rather than bytes.
+func stringsJustify(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var s string
+	var width int
+	var fillchar = " "
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "s", &s, "width", &width, "fillchar?", &fillchar)
+	if err != nil {
+		return nil, err
+	}
+	if utf8.RuneCountInString(fillchar) != 1 {
+		return nil, fmt.Errorf("%s: the fill character must be exactly one character long", fn.Name())
+	}
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return starlark.String(s), nil
+	}
+	fill := strings.Repeat(fillchar, n)
+	if fn.Name() == "strings.ljust" {
+		return starlark.String(s + fill), nil
+	}
+	return starlark.String(fill + s), nil
+}
+
+func stringsPartition(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var s, sep string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "s", &s, "sep", &sep)
+	if err != nil {
+		return nil, err
+	}
+	if sep == "" {
+		return nil, fmt.Errorf("%s: empty separator", fn.Name())
+	}
+	before, after, found := strings.Cut(s, sep)
+	if !found {
+		return starlark.Tuple{starlark.String(s), starlark.String(""), starlark.String("")}, nil
+	}
+	return starlark.Tuple{starlark.String(before), starlark.String(sep), starlark.String(after)}, nil
+}
@@ -0,0 +1,52 @@
+package scripts_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var stringsTests = []struct {
+	expr   string
+	result string
+	error  string
+}{
+	{expr: `strings.splitlines("")`, result: `[]`},
+	{expr: `strings.splitlines("\n")`, result: `[""]`},
+	{expr: `strings.splitlines("a\nb\r\nc\rd")`, result: `["a", "b", "c", "d"]`},
+	{expr: `strings.splitlines("a\n\nb\n")`, result: `["a", "", "b"]`},
+	{expr: `strings.splitlines("a\r\nb\x0bc\u2028d", keepends=True)`, result: `["a\r\n", "b\v", "c\u2028", "d"]`},
+	{expr: `strings.removeprefix("foobar", "foo")`, result: `"bar"`},
+	{expr: `strings.removeprefix("foobar", "bar")`, result: `"foobar"`},
+	{expr: `strings.removeprefix("foo", "")`, result: `"foo"`},
+	{expr: `strings.removesuffix("foobar", "bar")`, result: `"foo"`},
+	{expr: `strings.removesuffix("", "bar")`, result: `""`},
+	{expr: `strings.ljust("ab", 4)`, result: `"ab  "`},
+	{expr: `strings.ljust("ab", 4, "*")`, result: `"ab**"`},
+	{expr: `strings.ljust("abc", 2)`, result: `"abc"`},
+	{expr: `strings.rjust("ab", 4, "0")`, result: `"00ab"`},
+	{expr: `strings.rjust("ñ", 3, "é")`, result: `"ééñ"`},
+	{expr: `strings.rjust("", 0)`, result: `""`},
+	{expr: `strings.rjust("ab", -1)`, result: `"ab"`},
+	{expr: `strings.ljust("ab", 4, "**")`, error: `strings.ljust: the fill character must be exactly one character long`},
+	{expr: `strings.rjust("ab", 4, "")`, error: `strings.rjust: the fill character must be exactly one character long`},
+	{expr: `strings.partition("a=b=c", "=")`, result: `("a", "=", "b=c")`},
+	{expr: `strings.partition("abc", "=")`, result: `("abc", "", "")`},
+	{expr: `strings.partition("", "=")`, result: `("", "", "")`},
+	{expr: `strings.partition("abc", "")`, error: `strings.partition: empty separator`},
+	{expr: `strings.removeprefix(1, "a")`, error: `strings.removeprefix: for parameter s: got int, want string`},
+}
+
+func (s *S) TestStringsModule(c *C) {
+	namespace := map[string]scripts.Value{"strings": scripts.StringsModule()}
+	for _, test := range stringsTests {
+		c.Logf("Expression: %s", test.expr)
+		result, err := evalExpr(namespace, test.expr)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result)
+	}
+}
@@ -3,6 +3,7 @@ package scripts_test
 import (
 	"testing"
 
+	"go.starlark.net/starlark"
 	. "gopkg.in/check.v1"
 
 	"github.com/canonical/chisel/internal/scripts"
@@ -23,3 +24,24 @@ func (s *S) TearDownTest(c *C) {
 	scripts.SetDebug(false)
 	scripts.SetLogger(nil)
 }
+
+// evalExpr runs a script evaluating expr with the given namespace and
+// returns the representation of the resulting value.
+func evalExpr(namespace map[string]scripts.Value, expr string) (string, error) {
+	var result string
+	predeclared := map[string]scripts.Value{
+		"result": starlark.NewBuiltin("result", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			result = args[0].String()
+			return starlark.None, nil
+		}),
+	}
+	for name, value := range namespace {
+		predeclared[name] = value
+	}
+	err := scripts.Run(&scripts.RunOptions{
+		Label:     "test",
+		Namespace: predeclared,
+		Script:    "result(" + expr + ")",
+	})
+	return result, err
+}
@@ -0,0 +1,50 @@
+package scripts
+
+import (
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// TimeModule returns a module to obtain and format timestamps, which are
+// Unix times in seconds as taken by Content.touch and Content.set_times.
+// When the script runs with RunOptions.FixedTime set, now returns that
+// time instead of the current one. It's meant to be added to the
+// namespace of scripts, usually under the "time" name.
+func TimeModule() Value {
+	return &starlarkstruct.Module{
+		Name: "time",
+		Members: starlark.StringDict{
+			"now":    starlark.NewBuiltin("time.now", timeNow),
+			"format": starlark.NewBuiltin("time.format", timeFormat),
+		},
+	}
+}
+
+// fixedTimeKey is the thread-local key holding RunOptions.FixedTime.
+const fixedTimeKey = "scripts.fixedtime"
+
+func timeNow(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	now, ok := thread.Local(fixedTimeKey).(time.Time)
+	if !ok {
+		now = time.Now()
+	}
+	return starlark.MakeInt64(now.Unix()), nil
+}
+
+// timeFormat formats the timestamp in UTC according to layout, which
+// uses the reference time of Go's time package and defaults to RFC 3339.
+func timeFormat(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var ts int64
+	var layout = time.RFC3339
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "ts", &ts, "layout?", &layout)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(time.Unix(ts, 0).UTC().Format(layout)), nil
+}
@@ -0,0 +1,62 @@
+package scripts_test
+
+import (
+	"strconv"
+	"time"
+
+	"go.starlark.net/starlark"
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/scripts"
+)
+
+var timeTests = []struct {
+	expr   string
+	result string
+	error  string
+}{
+	{expr: `time.format(0)`, result: `"1970-01-01T00:00:00Z"`},
+	{expr: `time.format(1000000000)`, result: `"2001-09-09T01:46:40Z"`},
+	{expr: `time.format(1000000000, "2006-01-02")`, result: `"2001-09-09"`},
+	{expr: `time.format(1000000000, layout="15:04")`, result: `"01:46"`},
+	{expr: `time.format("0")`, error: `time.format: for parameter ts: got string, want int`},
+	{expr: `time.now(1)`, error: `time.now: got 1 arguments, want at most 0`},
+}
+
+func (s *S) TestTimeModule(c *C) {
+	namespace := map[string]scripts.Value{"time": scripts.TimeModule()}
+	for _, test := range timeTests {
+		c.Logf("Expression: %s", test.expr)
+		result, err := evalExpr(namespace, test.expr)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, test.result)
+	}
+
+	before := time.Now().Unix()
+	result, err := evalExpr(namespace, `time.now()`)
+	c.Assert(err, IsNil)
+	now, err := strconv.ParseInt(result, 10, 64)
+	c.Assert(err, IsNil)
+	c.Assert(now >= before && now <= time.Now().Unix(), Equals, true)
+}
+
+func (s *S) TestTimeModuleFixedTime(c *C) {
+	var result string
+	err := scripts.Run(&scripts.RunOptions{
+		Namespace: map[string]scripts.Value{
+			"time": scripts.TimeModule(),
+			"result": starlark.NewBuiltin("result", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				result = args[0].String()
+				return starlark.None, nil
+			}),
+		},
+		FixedTime: time.Date(2001, 9, 9, 3, 46, 40, 0, time.FixedZone("", 2*60*60)),
+		Script:    `result((time.now(), time.format(time.now())))`,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, `(1000000000, "2001-09-09T01:46:40Z")`)
+}
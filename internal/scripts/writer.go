@@ -0,0 +1,264 @@
+package scripts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"go.starlark.net/starlark"
+
+	"github.com/canonical/chisel/internal/fsutil"
+)
+
+// FileWriterValue is returned by Content.open_write to write a file in
+// pieces, without holding all of its data at once. The entry is reported
+// to OnWrite when the writer is closed.
+//
+// Writers still open when the script finishes are closed by Run. Those
+// in atomic mode are discarded so the file is left as it was, while the
+// others keep and report the data written until then.
+type FileWriterValue struct {
+	c      *ContentValue
+	path   string
+	fpath  string
+	mode   os.FileMode
+	atomic bool
+	// file is nil in dry-run mode. In atomic mode it is a temporary
+	// file in the same directory, renamed into place when closing.
+	file   *os.File
+	h      hash.Hash
+	size   int
+	closed bool
+}
+
+// writersKey is the thread-local key holding the writers opened by the
+// script running in the thread.
+const writersKey = "scripts.writers"
+
+// OpenWrite opens the file at path for writing, truncating it if it
+// exists. With atomic set, the data is written to a temporary file that
+// only replaces the one at path once the writer is closed.
+func (c *ContentValue) OpenWrite(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	var path starlark.String
+	var atomic bool
+	err := starlark.UnpackArgs("Content.open_write", args, kwargs, "path", &path, "atomic?", &atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := c.openWriter(path, 0644&^c.Umask, atomic)
+	if err != nil {
+		return nil, err
+	}
+	writers, _ := thread.Local(writersKey).(*[]*FileWriterValue)
+	if writers == nil {
+		writers = &[]*FileWriterValue{}
+		thread.SetLocal(writersKey, writers)
+	}
+	*writers = append(*writers, w)
+	return w, nil
+}
+
+// openWriter opens the file at path for writing as documented in
+// OpenWrite, with the given mode. The writer is not tracked by any
+// thread, so the caller must either close or discard it.
+func (c *ContentValue) openWriter(path starlark.String, mode fs.FileMode, atomic bool) (*FileWriterValue, error) {
+	fpath, err := c.RealPath(path.GoString(), CheckWrite)
+	if err != nil {
+		return nil, err
+	}
+	w := &FileWriterValue{
+		c:      c,
+		path:   filepath.Clean(path.GoString()),
+		fpath:  fpath,
+		mode:   mode,
+		atomic: atomic,
+		h:      sha256.New(),
+	}
+	if !c.DryRun {
+		if atomic {
+			w.file, err = os.CreateTemp(filepath.Dir(fpath), "."+filepath.Base(fpath)+".*")
+			if err == nil {
+				err = w.file.Chmod(w.mode)
+				if err != nil {
+					w.file.Close()
+					os.Remove(w.file.Name())
+				}
+			}
+		} else {
+			err = c.replaceSymlink(fpath)
+			if err == nil {
+				w.file, err = os.OpenFile(fpath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, w.mode)
+			}
+		}
+		if err != nil {
+			return nil, c.writeError(path, err)
+		}
+	}
+	return w, nil
+}
+
+// closeWriters closes all writers opened in thread that were not closed
+// by the script itself, as documented in FileWriterValue.
+func closeWriters(thread *starlark.Thread) error {
+	writers, _ := thread.Local(writersKey).(*[]*FileWriterValue)
+	if writers == nil {
+		return nil
+	}
+	var firstErr error
+	for _, w := range *writers {
+		if w.closed {
+			continue
+		}
+		var err error
+		if w.atomic {
+			err = w.discard()
+		} else {
+			_, err = w.close()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (w *FileWriterValue) write(data string) error {
+	if w.closed {
+		return fmt.Errorf("FileWriter.write: writer is closed")
+	}
+	if w.c.frozen.Load() {
+		return fmt.Errorf("cannot write to frozen Content")
+	}
+	err := w.c.checkWriteSize(starlark.String(w.path), int64(w.size+len(data)))
+	if err != nil {
+		return err
+	}
+	if w.file != nil {
+		_, err := w.file.WriteString(data)
+		if err != nil {
+			return w.c.writeError(starlark.String(w.path), err)
+		}
+	}
+	w.h.Write([]byte(data))
+	w.size += len(data)
+	return nil
+}
+
+func (w *FileWriterValue) close() (*fsutil.Entry, error) {
+	if w.closed {
+		return nil, fmt.Errorf("FileWriter.close: writer is closed")
+	}
+	w.closed = true
+	if w.file != nil {
+		err := w.file.Close()
+		if err == nil && w.atomic {
+			err = osRename(w.file.Name(), w.fpath)
+		}
+		if err != nil {
+			if w.atomic {
+				os.Remove(w.file.Name())
+			}
+			if e, ok := err.(*os.LinkError); ok {
+				err = &os.PathError{Op: e.Op, Path: w.path, Err: e.Err}
+			}
+			return nil, w.c.writeError(starlark.String(w.path), err)
+		}
+	}
+	entry := &fsutil.Entry{
+		Path: w.path,
+		Mode: w.mode,
+		Hash: hex.EncodeToString(w.h.Sum(nil)),
+		Size: w.size,
+	}
+	err := w.c.reportWrite(entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (w *FileWriterValue) discard() error {
+	w.closed = true
+	if w.file == nil {
+		return nil
+	}
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+// FileWriter starlark.Value interface
+// --------------------------------------------------------------------------
+
+func (w *FileWriterValue) String() string {
+	return "FileWriter{" + w.path + "}"
+}
+
+func (w *FileWriterValue) Type() string {
+	return "FileWriter"
+}
+
+func (w *FileWriterValue) Freeze() {
+	// Writers are used up as they are written to, so they cannot be
+	// frozen in a meaningful way.
+}
+
+func (w *FileWriterValue) Truth() starlark.Bool {
+	return true
+}
+
+func (w *FileWriterValue) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: FileWriter")
+}
+
+// FileWriter starlark.HasAttrs interface
+// --------------------------------------------------------------------------
+
+var _ starlark.HasAttrs = new(FileWriterValue)
+
+func (w *FileWriterValue) Attr(name string) (Value, error) {
+	switch name {
+	case "path":
+		return starlark.String(w.path), nil
+	case "write":
+		return starlark.NewBuiltin("FileWriter.write", w.Write), nil
+	case "close":
+		return starlark.NewBuiltin("FileWriter.close", w.Close), nil
+	}
+	return nil, nil
+}
+
+func (w *FileWriterValue) AttrNames() []string {
+	return []string{"close", "path", "write"}
+}
+
+// Write appends data, which may be a string or bytes, to the file.
+func (w *FileWriterValue) Write(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	data, err := unpackData(fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	err = w.write(data)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+// Close finishes writing the file, reports it to OnWrite, and returns
+// its entry.
+func (w *FileWriterValue) Close(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (Value, error) {
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := w.close()
+	if err != nil {
+		return nil, err
+	}
+	return NewEntryValue(entry), nil
+}
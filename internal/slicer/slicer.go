@@ -265,12 +265,14 @@ func Run(options *RunOptions) (*Report, error) {
 	// Run mutation scripts. Order is fundamental here as
 	// dependencies must run before dependents.
 	checker := contentChecker{knownPaths}
-	content := &scripts.ContentValue{
-		RootDir:    targetDirAbs,
-		CheckWrite: checker.checkMutable,
-		CheckRead:  checker.checkKnown,
-	}
 	for _, slice := range options.Selection.Slices {
+		// Each script gets its own content value, so that closing it
+		// does not affect the scripts of other slices.
+		content := &scripts.ContentValue{
+			RootDir:    targetDirAbs,
+			CheckWrite: checker.checkMutable,
+			CheckRead:  checker.checkKnown,
+		}
 		opts := scripts.RunOptions{
 			Label:  "mutate",
 			Script: slice.Scripts.Mutate,
@@ -279,6 +281,9 @@ func Run(options *RunOptions) (*Report, error) {
 			},
 		}
 		err := scripts.Run(&opts)
+		if err == nil {
+			err = content.Close()
+		}
 		if err != nil {
 			return nil, fmt.Errorf("slice %s: %w", slice, err)
 		}
@@ -556,6 +556,36 @@ var slicerTests = []slicerTest{{
 						content.read("/dir/nested/file")
 		`,
 	},
+}, {
+	summary: "Script: closing content does not affect other slices",
+	slices:  []setup.SliceKey{{"test-package", "myslice1"}, {"test-package", "myslice2"}},
+	release: map[string]string{
+		"slices/mydir/test-package.yaml": `
+			package: test-package
+			slices:
+				myslice1:
+					contents:
+						/dir/text-file-1: {text: data1, mutable: true}
+					mutate: |
+						content.write("/dir/text-file-1", "data2")
+						content.close()
+				myslice2:
+					contents:
+						/dir/text-file-2: {text: data1, mutable: true}
+					mutate: |
+						content.write("/dir/text-file-2", "data3")
+						content.close()
+		`,
+	},
+	filesystem: map[string]string{
+		"/dir/":            "dir 0755",
+		"/dir/text-file-1": "file 0644 d98cf53e",
+		"/dir/text-file-2": "file 0644 f60f2d65",
+	},
+	report: map[string]string{
+		"/dir/text-file-1": "file 0644 5b41362b {test-package_myslice1}",
+		"/dir/text-file-2": "file 0644 5b41362b {test-package_myslice2}",
+	},
 }, {
 	summary: "Relative content root directory must not error",
 	slices:  []setup.SliceKey{{"test-package", "myslice"}},
@@ -697,11 +727,25 @@ var slicerTests = []slicerTest{{
 					mutate: |
 						content.list("/////")
 						content.list("/a/")
-						content.list("/a/b/../b/")
 						content.list("/x///")
 						content.list("/x/./././y")
 		`,
 	},
+}, {
+	summary: "Cannot list paths with .. components",
+	slices:  []setup.SliceKey{{"test-package", "myslice"}},
+	release: map[string]string{
+		"slices/mydir/test-package.yaml": `
+			package: test-package
+			slices:
+				myslice:
+					contents:
+						/a/b/c: {text: foo}
+					mutate: |
+						content.list("/a/b/../b/")
+		`,
+	},
+	error: `slice test-package_myslice: invalid content path: /a/b/../b/`,
 }, {
 	summary: "Cannot read directories",
 	slices:  []setup.SliceKey{{"test-package", "myslice"}},